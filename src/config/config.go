@@ -1,3 +1,165 @@
 package config
 
-var ChunkSize int = 16 * 1024
\ No newline at end of file
+var ChunkSize int = 16 * 1024
+
+// number of times a udp tracker request is retransmitted before giving up.
+// BEP 15 allows up to 8 (15 * 2 ^ 8 seconds), which is far too long to
+// wait on a dead tracker, so we stop early.
+// see: http://bittorrent.org/beps/bep_0015.html
+var TrackerMaxRetransmits int = 2
+
+// seconds to wait on each tracker in the quick first pass through the
+// tiers, made before the full retry schedule so dead trackers early in
+// the list don't hold up the ones that work
+var TrackerQuickTimeout int = 3
+
+// seconds to wait between announces when a tracker doesn't tell us
+var TrackerDefaultInterval int = 30 * 60
+
+// the shortest time in seconds we'll wait before re-announcing early
+// because we're running low on peers
+var TrackerMinInterval int = 5 * 60
+
+// ask the trackers for more peers when fewer than this many are connected
+var MinPeers int = 10
+
+// announce to the first working tracker of every tier at once instead of
+// only falling through to the next tier when all trackers in a tier fail
+var AnnounceToAllTiers bool = false
+
+// dial, listen and announce over ipv6 as well as ipv4
+var EnableIPv6 bool = true
+
+// port we accept incoming peer connections on
+var ListenPort int = 6881
+
+// announce torrents to, and find peers on, the local network
+var EnableLSD bool = true
+
+// interface to send and receive local service discovery messages on,
+// empty for the system default
+var LSDInterface string = ""
+
+// seconds between local service discovery announces for each torrent
+var LSDInterval int = 5 * 60
+
+// message stream encryption for peer connections. "disabled" only speaks
+// plaintext, "prefer" tries encryption first and falls back to plaintext,
+// "require" refuses unencrypted connections
+var EncryptionPolicy string = "prefer"
+
+// which transports to dial peers over and in what order. "tcp" and "utp"
+// use only that transport, "prefer_utp" and "prefer_tcp" fall back to the
+// other one when the first fails
+var TransportPreference string = "prefer_utp"
+
+// negotiate the fast extension with peers that support it, so choked
+// peers can still serve allowed fast pieces and rejected requests are
+// returned straight away
+var EnableFastExtension bool = true
+
+// seconds to wait for a peer to answer a chunk request before the chunk
+// is handed back to the pool for another peer
+var RequestTimeout int = 30
+
+// seconds without receiving any piece data before a peer is considered
+// snubbed. snubbed peers are only given chunks from the back of the
+// torrent so they can't hold up the pieces a stream needs next
+var SnubTimeout int = 60
+
+// seconds between keep-alives on an otherwise quiet peer connection
+var KeepAliveInterval int = 2 * 60
+
+// seconds a peer connection may go without a message other than a
+// keep-alive in either direction before it's closed, 0 to never close
+var IdleTimeout int = 5 * 60
+
+// seconds a connection may stay open when neither side is interested in
+// the other
+var UninterestedTimeout int = 60
+
+// the most outgoing connections that may be in progress at once
+var MaxHalfOpen int = 8
+
+// the most peer connections open at once, across every torrent
+var MaxConnections int = 200
+
+// the most peer connections open at once for a single torrent
+var MaxConnectionsPerTorrent int = 50
+
+// seconds to wait before reconnecting to a peer that failed or dropped,
+// doubled with each failure up to MaxReconnectBackoff
+var ReconnectBackoff int = 30
+var MaxReconnectBackoff int = 30 * 60
+
+// failures in a row before a peer is forgotten
+var MaxPeerFailures int = 5
+
+// download and upload limits in KiB/s shared by every torrent, 0 for
+// unlimited
+var DownloadLimit int = 0
+var UploadLimit int = 0
+
+// download and upload limits in KiB/s for each torrent, 0 for unlimited
+var TorrentDownloadLimit int = 0
+var TorrentUploadLimit int = 0
+
+// alternate global limits in KiB/s, used instead of the ones above while
+// switched on from the ui or during the scheduled hours
+var AltDownloadLimit int = 256
+var AltUploadLimit int = 64
+
+// use the alternate limits every day from AltLimitsFrom until AltLimitsTo,
+// both "15:04" in local time. the window may run past midnight
+var AltLimitsScheduled bool = false
+var AltLimitsFrom string = "09:00"
+var AltLimitsTo string = "17:00"
+
+// blocklists of address ranges we won't connect to or accept connections
+// from, in p2p, dat or cidr format. reloaded on SIGHUP or from the ui
+var IPFilterFiles []string = []string{}
+
+// send peer connections and tracker requests through a proxy. "" for no
+// proxy, "socks5", or "http" for a proxy supporting CONNECT. udp trackers
+// can only be reached through a socks5 proxy
+var ProxyType string = ""
+var ProxyAddress string = ""
+var ProxyUsername string = ""
+var ProxyPassword string = ""
+
+// refuse any connection that doesn't go through the proxy, and turn off
+// anything that would reveal our address: incoming connections, utp and
+// local service discovery
+var ProxyOnly bool = false
+
+// connect to i2p peers and trackers, and accept connections from i2p
+// peers, through the sam bridge of a local i2p router
+var EnableI2P bool = false
+var SAMAddress string = "127.0.0.1:7656"
+// the name of our sam session, unique among clients of the router
+var I2PSessionName string = "uvgTorrent"
+
+// the directory torrents are saved in, unless one is given on the command
+// line
+var DownloadDir string = "downloads"
+
+// keep torrents here while they download and move them to their save path
+// once they complete. empty to download straight to the save path
+var IncompleteDir string = ""
+
+// save each torrents files in a folder named after the torrent
+var CreateRootFolder bool = true
+
+// how space is allocated for files as they're created. "full" reserves
+// all of it up front so the file isn't fragmented, "sparse" sets the
+// files length without allocating anything and "compact" lets the file
+// grow as it's written
+var AllocationMode string = "sparse"
+
+// bytes of consecutive writes to a file that are held in memory and
+// written in one go
+var WriteBufferSize int = 1024 * 1024
+
+// seconds between flushing what's been written to disk. 0 only flushes
+// files as they're closed
+var FlushInterval int = 30
@@ -0,0 +1,83 @@
+package connection
+
+import (
+	"../config"
+	"sync"
+)
+
+// counts connections across every torrent so the global limits on
+// half open dials and open connections can be kept
+type Manager struct {
+	half_open   int
+	connections int
+	lock        sync.Mutex
+}
+
+// the manager torrents share unless given another
+var DefaultManager = NewManager()
+
+func NewManager() *Manager {
+	m := Manager{}
+
+	return &m
+}
+
+// reserve a connection and a half open slot for an outgoing dial.
+// false if either limit has been reached
+func (m *Manager) reserveDial() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.half_open >= config.MaxHalfOpen || m.connections >= config.MaxConnections {
+		return false
+	}
+	m.half_open++
+	m.connections++
+
+	return true
+}
+
+// a dial finished, giving back its connection if it failed
+func (m *Manager) dialed(connected bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.half_open--
+	if connected == false {
+		m.connections--
+	}
+}
+
+// reserve a connection for a peer that connected to us
+func (m *Manager) reserveIncoming() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.connections >= config.MaxConnections {
+		return false
+	}
+	m.connections++
+
+	return true
+}
+
+func (m *Manager) release() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.connections--
+}
+
+func (m *Manager) GetHalfOpen() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.half_open
+}
+
+func (m *Manager) GetConnections() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.connections
+}
@@ -0,0 +1,243 @@
+package connection
+
+import (
+	"../config"
+	"../ipfilter"
+	"../peer"
+	"time"
+)
+
+// how much we prefer peers from each source, lowest first. peers from the
+// magnet link were picked by the user, peers on the local network are
+// likely the fastest, and a peer we're already talking to is known to be
+// alive
+var source_rank = map[int]int{
+	peer.SourceMagnet:  0,
+	peer.SourceLSD:     1,
+	peer.SourceAlt:     2,
+	peer.SourceTracker: 3,
+}
+
+// a peer we know about
+type candidate struct {
+	address   peer.Address
+	source    int
+	// the swarm we heard of the peer in
+	info_hash []byte
+	// failed or dropped connections in a row
+	failures  int
+	last_seen time.Time
+	// don't dial again before this
+	retry_at  time.Time
+
+	// the peer we're dialling or connected to, nil when idle
+	peer         *peer.Peer
+	connected    bool
+	connected_at time.Time
+	// the blocklist blocks the peer now, it's forgotten once it closes
+	blocked      bool
+}
+
+// the peers of a single torrent. rather than dialling every peer as soon
+// as we hear of it, peers are queued and the best are dialled while the
+// torrents and the managers limits allow. peers that fail or drop are
+// dialled again after a backoff
+type Pool struct {
+	manager    *Manager
+	// every peer we know about, keyed on address
+	candidates map[string]*candidate
+	// peers dialling or connected
+	active     int
+}
+
+func NewPool(m *Manager) *Pool {
+	p := Pool{}
+	p.manager = m
+	p.candidates = make(map[string]*candidate)
+
+	return &p
+}
+
+// queue a peer a tracker, the local network or another peer told us about
+func (p *Pool) Add(pe *peer.Peer) {
+	c, ok := p.candidates[pe.GetAddr()]
+	if ok == false {
+		c = &candidate{address: pe.GetAddress(), source: pe.GetSource(), info_hash: pe.GetInfoHash()}
+		p.candidates[pe.GetAddr()] = c
+	} else if rank, ok := source_rank[pe.GetSource()]; ok && rank < source_rank[c.source] {
+		c.source = pe.GetSource()
+	}
+
+	c.last_seen = time.Now()
+}
+
+// take a peer that connected to us. false if we're already talking to
+// it or a limit has been reached, in which case it should be closed
+func (p *Pool) Accept(pe *peer.Peer) bool {
+	if c, ok := p.candidates[pe.GetAddr()]; ok && c.peer != nil {
+		return false
+	}
+	if p.active >= config.MaxConnectionsPerTorrent || p.manager.reserveIncoming() == false {
+		return false
+	}
+
+	now := time.Now()
+	p.candidates[pe.GetAddr()] = &candidate{
+		address:      pe.GetAddress(),
+		source:       pe.GetSource(),
+		info_hash:    pe.GetInfoHash(),
+		last_seen:    now,
+		peer:         pe,
+		connected:    true,
+		connected_at: now,
+	}
+	p.active++
+
+	return true
+}
+
+// notice peers that finished dialling or dropped, then pick the best
+// candidates to dial while the limits allow. the peers returned are new
+// and need to be run
+func (p *Pool) Update() []*peer.Peer {
+	now := time.Now()
+
+	for addr, c := range p.candidates {
+		if c.peer == nil {
+			continue
+		}
+
+		if c.peer.IsClosed() {
+			if c.connected {
+				p.manager.release()
+				// a connection that lasted counts as a success
+				if now.Sub(c.connected_at) >= backoff(1) {
+					c.failures = 0
+				}
+			} else {
+				p.manager.dialed(false)
+			}
+			c.failures++
+			c.peer = nil
+			c.connected = false
+			p.active--
+
+			// incoming peers connected from a port we can't dial
+			if c.blocked || c.source == peer.SourceIncoming || c.failures >= config.MaxPeerFailures {
+				delete(p.candidates, addr)
+			} else {
+				c.retry_at = now.Add(backoff(c.failures))
+			}
+		} else if c.connected == false && c.peer.IsConnected() {
+			p.manager.dialed(true)
+			c.connected = true
+			c.connected_at = now
+			// blocked while it was being dialled
+			if c.blocked {
+				c.peer.Close()
+			}
+		}
+	}
+
+	dial := make([]*peer.Peer, 0)
+	for p.active < config.MaxConnectionsPerTorrent {
+		c := p.best(now)
+		if c == nil || p.manager.reserveDial() == false {
+			break
+		}
+
+		c.peer = peer.NewPeerAt(c.address)
+		c.peer.SetSource(c.source)
+		c.peer.SetInfoHash(c.info_hash)
+		p.active++
+
+		dial = append(dial, c.peer)
+	}
+
+	return dial
+}
+
+// drop the peers the blocklist blocks, after it's been reloaded. idle
+// peers are forgotten straight away and connected ones are closed, to be
+// forgotten by Update. ones still being dialled are closed once they
+// connect
+func (p *Pool) RemoveBlocked() {
+	for addr, c := range p.candidates {
+		if c.address.IsI2P() || ipfilter.Default.IsBlocked(c.address.IP) == false {
+			continue
+		}
+
+		if c.peer == nil {
+			delete(p.candidates, addr)
+			continue
+		}
+		c.blocked = true
+		if c.peer.IsConnected() {
+			c.peer.Close()
+		}
+	}
+}
+
+// the candidate we'd most like to dial now, preferring better sources,
+// then fewer failures, then the most recently seen. nil if there's none
+func (p *Pool) best(now time.Time) *candidate {
+	var best *candidate
+	for _, c := range p.candidates {
+		if c.peer != nil || c.retry_at.After(now) {
+			continue
+		}
+
+		switch {
+		case best == nil:
+			best = c
+		case source_rank[c.source] != source_rank[best.source]:
+			if source_rank[c.source] < source_rank[best.source] {
+				best = c
+			}
+		case c.failures != best.failures:
+			if c.failures < best.failures {
+				best = c
+			}
+		case c.last_seen.After(best.last_seen):
+			best = c
+		}
+	}
+
+	return best
+}
+
+// peers dialling or connected
+func (p *Pool) GetPeers() []*peer.Peer {
+	peers := make([]*peer.Peer, 0)
+	for _, c := range p.candidates {
+		if c.peer != nil {
+			peers = append(peers, c.peer)
+		}
+	}
+
+	return peers
+}
+
+// the number of peers we know the address of
+func (p *Pool) GetKnown() int {
+	return len(p.candidates)
+}
+
+func (p *Pool) IsKnown(addr string) bool {
+	_, ok := p.candidates[addr]
+	return ok
+}
+
+// how long to wait before dialling a peer again after failures in a row
+func backoff(failures int) time.Duration {
+	wait := time.Duration(config.ReconnectBackoff) * time.Second
+	max := time.Duration(config.MaxReconnectBackoff) * time.Second
+	for i := 1; i < failures && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+
+	return wait
+}
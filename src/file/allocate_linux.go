@@ -0,0 +1,17 @@
+package file
+
+import (
+	"os"
+	"syscall"
+)
+
+// reserve the blocks for the first length bytes of the file. filesystems
+// that can't do that just have the length set
+func allocate(fh *os.File, length int64) error {
+	err := syscall.Fallocate(int(fh.Fd()), 0, 0, length)
+	if err == syscall.EOPNOTSUPP {
+		return fh.Truncate(length)
+	}
+
+	return err
+}
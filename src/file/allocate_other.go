@@ -0,0 +1,13 @@
+// +build !linux
+
+package file
+
+import (
+	"os"
+)
+
+// there's no fallocate, so setting the length is the best we can do.
+// on windows this allocates the space, elsewhere the file may be sparse
+func allocate(fh *os.File, length int64) error {
+	return fh.Truncate(length)
+}
@@ -1,23 +1,57 @@
 package file
 
 import (
+	"../config"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"strings"
 	"path/filepath"
+	"sync"
 )
 
 type File struct {
 	start_piece  int64
 	end_piece    int64
 	length       int64
+	// the directory the torrent is saved in, the torrents own folder in
+	// it if it has one, and the files path within the torrent
+	dir          string
+	root         string
 	path         []string
-	downloadable bool
+	priority     Priority
+	// attributes from the torrent: p for padding, x executable, h hidden
+	// and l for a symlink to symlink_path, relative to the torrents folder
+	// see: http://bittorrent.org/beps/bep_0047.html
+	attr         string
+	symlink_path []string
+
+	// v2 torrents verify pieces against a merkle tree per file. files
+	// longer than a piece need the trees piece layer, which we get from
+	// peers a part at a time
+	pieces_root  []byte
+	piece_length int64
+	piece_layer  [][]byte
+	layer_lock   sync.Mutex
 
 	file_handle  *os.File
+	// consecutive writes not yet written to the file, starting at
+	// pending_pos
+	pending      []byte
+	pending_pos  int64
 }
 
+// how keen we are to download a file. pieces are picked from the files
+// with the highest priority first, and skipped files aren't downloaded
+type Priority int
+
+const (
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
 func NewFile(length int64, path []string) *File {
 	f := File{}
 	f.length = length
@@ -34,8 +68,29 @@ func (f *File) SetEndPiece(end_piece int64) {
 	f.end_piece = end_piece
 }
 
+// download the file at normal priority, or skip it
 func (f *File) SetDownloadable(downloadable bool) {
-	f.downloadable = downloadable
+	if downloadable {
+		f.SetPriority(PriorityNormal)
+	} else {
+		f.SetPriority(PrioritySkip)
+	}
+}
+
+// padding files are never downloaded
+func (f *File) SetPriority(priority Priority) {
+	if f.IsPadding() || priority < PrioritySkip {
+		priority = PrioritySkip
+	}
+	if priority > PriorityHigh {
+		priority = PriorityHigh
+	}
+
+	f.priority = priority
+}
+
+func (f *File) GetPriority() Priority {
+	return f.priority
 }
 
 func (f *File) GetStartAndEndPieces() (int64, int64) {
@@ -43,60 +98,324 @@ func (f *File) GetStartAndEndPieces() (int64, int64) {
 }
 
 func (f *File) IsDownloadable() bool {
-	return f.downloadable
+	return f.priority != PrioritySkip
+}
+
+// where the file is saved: the directory the torrent is in and the
+// torrents folder, empty if its files go straight in the directory
+func (f *File) SetLocation(dir string, root string) {
+	f.dir = dir
+	f.root = root
+}
+
+func (f *File) GetDir() string {
+	return f.dir
 }
 
+// the files full path, made of the save directory, the torrents folder
+// and the path within the torrent
 func (f *File) GetPath() []string {
-	return f.path
+	path := []string{f.dir}
+	if f.root != "" {
+		path = append(path, f.root)
+	}
+
+	return append(path, f.path...)
 }
 
+// the path within the torrent
 func (f *File) GetDisplayPath() []string {
-	return f.path[2:]
+	return f.path
 }
 
 func (f *File) GetLength() int64 {
 	return f.length
 }
 
-func (f *File) Write(data []byte, pos int64) {
+func (f *File) SetAttributes(attr string, symlink_path []string) {
+	f.attr = attr
+	f.symlink_path = symlink_path
+}
+
+// padding files fill the rest of a piece so the next file starts on a
+// new one. they're all zeros and never written
+func (f *File) IsPadding() bool {
+	return strings.Contains(f.attr, "p")
+}
+
+func (f *File) IsExecutable() bool {
+	return strings.Contains(f.attr, "x")
+}
+
+func (f *File) IsHidden() bool {
+	return strings.Contains(f.attr, "h")
+}
+
+func (f *File) IsSymlink() bool {
+	return strings.Contains(f.attr, "l") && len(f.symlink_path) > 0
+}
+
+// create a symlink file, pointing at its target relative to where the
+// link is. targets outside the torrent are refused
+func (f *File) Link() error {
+	if f.IsSymlink() == false || f.IsDownloadable() == false {
+		return nil
+	}
+
+	for _, element := range f.symlink_path {
+		if element == ".." || element == "." || element == "" || strings.ContainsAny(element, "/\\") {
+			return fmt.Errorf("symlink target %q leaves the torrent", strings.Join(f.symlink_path, "/"))
+		}
+	}
+
+	path := f.GetPath()
+	folder_path := filepath.Join(path[0 : len(path)-1]...)
+	os.MkdirAll(folder_path, os.ModePerm)
+
+	target := filepath.Join(append([]string{f.dir, f.root}, f.symlink_path...)...)
+	relative, err := filepath.Rel(folder_path, target)
+	if err != nil {
+		return err
+	}
+
+	link_path := filepath.Join(path...)
+	os.Remove(link_path)
+
+	return os.Symlink(relative, link_path)
+}
+
+func (f *File) SetPiecesRoot(root []byte, piece_length int64) {
+	f.pieces_root = root
+	f.piece_length = piece_length
+}
+
+func (f *File) GetPiecesRoot() []byte {
+	return f.pieces_root
+}
+
+func (f *File) GetPieceLength() int64 {
+	return f.piece_length
+}
+
+// the number of pieces the file spans
+func (f *File) GetPieceCount() int {
+	return int(f.end_piece - f.start_piece + 1)
+}
+
+// store verified piece layer hashes, starting from the files piece at index
+func (f *File) SetPieceHashes(index int, hashes [][]byte) {
+	f.layer_lock.Lock()
+	defer f.layer_lock.Unlock()
+
+	if f.piece_layer == nil {
+		f.piece_layer = make([][]byte, f.GetPieceCount())
+	}
+	for i, hash := range hashes {
+		if index+i < len(f.piece_layer) {
+			f.piece_layer[index+i] = hash
+		}
+	}
+}
+
+// the piece layer hash of the files piece at index, nil if we don't have it
+func (f *File) GetPieceHash(index int) []byte {
+	f.layer_lock.Lock()
+	defer f.layer_lock.Unlock()
+
+	if index < 0 || index >= len(f.piece_layer) {
+		return nil
+	}
+
+	return f.piece_layer[index]
+}
+
+// write data at pos. writes that carry on from the last one are held
+// until there's enough of them to be worth writing, or Flush is called
+func (f *File) Write(data []byte, pos int64) error {
 	if f.IsDownloadable() == false {
-		return
+		return nil
 	}
 	
 	if f.file_handle == nil {
-		// create folders if needed
-		path := f.GetPath()
-		file_path := fmt.Sprintf("%s", strings.Join(path, "/"))
-		folder_path := fmt.Sprintf("%s", strings.Join(path[0:len(path)-1], "/"))
-		os.MkdirAll(filepath.Join(folder_path), os.ModePerm)
-
-		fh, err := os.OpenFile(
-			file_path,
-			os.O_WRONLY|os.O_SYNC|os.O_CREATE,
-			0666,
-		)
-		f.file_handle = fh
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+
+	if pos != f.pending_pos+int64(len(f.pending)) || len(f.pending)+len(data) > config.WriteBufferSize {
+		if err := f.writePending(); err != nil {
+			return err
+		}
+		f.pending_pos = pos
+	}
+	f.pending = append(f.pending, data...)
+
+	if len(f.pending) >= config.WriteBufferSize {
+		return f.writePending()
+	}
+
+	return nil
+}
 
+// create the file, allocating space for it as configured. if that fails
+// the file is left closed, to be tried again on the next write
+func (f *File) open() error {
+	// create folders if needed
+	path := f.GetPath()
+	file_path := filepath.Join(path...)
+	folder_path := filepath.Join(path[0:len(path)-1]...)
+	os.MkdirAll(folder_path, os.ModePerm)
+
+	mode := os.FileMode(0666)
+	if f.IsExecutable() {
+		mode = 0777
+	}
+
+	fh, err := os.OpenFile(
+		file_path,
+		os.O_WRONLY|os.O_CREATE,
+		mode,
+	)
+	if err != nil {
+		return err
+	}
+
+	// a file that's already as long as it should be is left alone
+	info, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	if info.Size() < f.length {
+		switch config.AllocationMode {
+		case "full":
+			err = allocate(fh, f.length)
+		case "sparse":
+			err = fh.Truncate(f.length)
+		}
 		if err != nil {
-			log.Fatal(err)
+			fh.Close()
+			return fmt.Errorf("couldn't allocate %s: %v", file_path, err)
 		}
 	}
 
-	var whence int = 0
-	_, err := f.file_handle.Seek(pos, whence)
+	if f.IsHidden() {
+		setHidden(file_path)
+	}
+	f.file_handle = fh
+
+	return nil
+}
+
+func (f *File) writePending() error {
+	if len(f.pending) == 0 {
+		return nil
+	}
+
+	n, err := f.file_handle.WriteAt(f.pending, f.pending_pos)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if n != len(f.pending) {
+		return io.ErrShortWrite
+	}
+
+	f.pending = f.pending[:0]
+
+	return nil
+}
+
+// write out anything held back and make sure it's on disk
+func (f *File) Flush() error {
+	if f.file_handle == nil {
+		return nil
+	}
+
+	if err := f.writePending(); err != nil {
+		return err
 	}
 
-	// Write bytes to file
-	n, err := f.file_handle.Write(data)
-	if err != nil || n != len(data) {
-		log.Fatal(err)
+	return f.file_handle.Sync()
+}
+
+// flush and close the file. it's closed even if the flush fails
+func (f *File) Close() error {
+	if f.file_handle == nil {
+		return nil
 	}
+
+	err := f.Flush()
+	f.file_handle.Close()
+	f.file_handle = nil
+
+	return err
 }
 
-func (f *File) Close() {
-	if f.file_handle != nil {
-		f.file_handle.Close()
+// move the file to another save directory. it's closed first and opened
+// again in its new place on the next write. files we haven't created yet
+// only have their location changed
+func (f *File) Move(dir string) error {
+	old_path := filepath.Join(f.GetPath()...)
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	old_dir := f.dir
+	f.dir = dir
+	new_path := filepath.Join(f.GetPath()...)
+	if old_path == new_path {
+		return nil
 	}
+
+	if _, err := os.Lstat(old_path); os.IsNotExist(err) {
+		return nil
+	}
+
+	// links point relative to where they are, so they're made again
+	if f.IsSymlink() {
+		os.Remove(old_path)
+		return f.Link()
+	}
+
+	if err := os.MkdirAll(filepath.Dir(new_path), os.ModePerm); err != nil {
+		f.dir = old_dir
+		return err
+	}
+	if err := os.Rename(old_path, new_path); err == nil {
+		return nil
+	}
+
+	// rename can't move between filesystems, so copy instead
+	if err := copyFile(old_path, new_path); err != nil {
+		os.Remove(new_path)
+		f.dir = old_dir
+		return err
+	}
+
+	return os.Remove(old_path)
+}
+
+func copyFile(from string, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
 }
@@ -0,0 +1,62 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := NewFile(6, []string{"folder", "name.txt"})
+	f.SetLocation(dir, "")
+	f.SetPriority(PriorityNormal)
+
+	if err := f.Write([]byte("abc"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Write([]byte("def"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "folder", "name.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "abcdef" {
+		t.Errorf("file = %q, want %q", data, "abcdef")
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a file where the files folder should be
+	if err := ioutil.WriteFile(filepath.Join(dir, "folder"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewFile(3, []string{"folder", "name.txt"})
+	f.SetLocation(dir, "")
+	f.SetPriority(PriorityNormal)
+
+	if err := f.Write([]byte("abc"), 0); err == nil {
+		t.Errorf("write to a file that can't be created succeeded")
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("close of a file that was never opened = %v", err)
+	}
+}
@@ -0,0 +1,8 @@
+// +build !windows
+
+package file
+
+// files are hidden by their name starting with a dot, which we can't
+// change without moving the file
+func setHidden(path string) {
+}
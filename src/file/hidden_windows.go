@@ -0,0 +1,19 @@
+package file
+
+import (
+	"syscall"
+)
+
+// mark a file hidden, as files starting with a dot are elsewhere
+func setHidden(path string) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return
+	}
+
+	attributes, err := syscall.GetFileAttributes(name)
+	if err != nil {
+		return
+	}
+	syscall.SetFileAttributes(name, attributes|syscall.FILE_ATTRIBUTE_HIDDEN)
+}
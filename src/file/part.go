@@ -0,0 +1,121 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// a part file holds the data of verified pieces that belongs to files we
+// don't download, so a piece shared with a file we do download doesn't
+// have to be downloaded again if that file is wanted later. each piece
+// has a slot the size of a piece, at the offset it would have in one big
+// file, and slots that are never written stay holes in the file
+type PartFile struct {
+	dir          string
+	name         string
+	piece_length int64
+
+	file_handle  *os.File
+}
+
+func NewPartFile(dir string, name string, piece_length int64) *PartFile {
+	pf := PartFile{}
+	pf.dir = dir
+	pf.name = name
+	pf.piece_length = piece_length
+
+	return &pf
+}
+
+func (pf *PartFile) GetPath() string {
+	return filepath.Join(pf.dir, pf.name)
+}
+
+// write data to the slot of piece index, start bytes into the piece
+func (pf *PartFile) WritePiece(index int64, data []byte, start int64) error {
+	if err := pf.open(); err != nil {
+		return err
+	}
+
+	_, err := pf.file_handle.WriteAt(data, index*pf.piece_length+start)
+
+	return err
+}
+
+// read len(data) bytes from the slot of piece index, start bytes into
+// the piece
+func (pf *PartFile) ReadPiece(index int64, data []byte, start int64) error {
+	if err := pf.open(); err != nil {
+		return err
+	}
+
+	_, err := pf.file_handle.ReadAt(data, index*pf.piece_length+start)
+
+	return err
+}
+
+// the part file is created the first time it's needed
+func (pf *PartFile) open() error {
+	if pf.file_handle != nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(pf.dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	fh, err := os.OpenFile(pf.GetPath(), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	pf.file_handle = fh
+
+	return nil
+}
+
+func (pf *PartFile) Close() {
+	if pf.file_handle != nil {
+		pf.file_handle.Close()
+		pf.file_handle = nil
+	}
+}
+
+// delete the part file, if it was ever created
+func (pf *PartFile) Remove() {
+	pf.Close()
+	os.Remove(pf.GetPath())
+}
+
+// move the part file to another directory along with the torrents files
+func (pf *PartFile) Move(dir string) error {
+	old_path := pf.GetPath()
+	pf.Close()
+
+	old_dir := pf.dir
+	pf.dir = dir
+	new_path := pf.GetPath()
+	if old_path == new_path {
+		return nil
+	}
+
+	if _, err := os.Stat(old_path); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		pf.dir = old_dir
+		return err
+	}
+	if err := os.Rename(old_path, new_path); err == nil {
+		return nil
+	}
+
+	// rename can't move between filesystems, so copy instead
+	if err := copyFile(old_path, new_path); err != nil {
+		os.Remove(new_path)
+		pf.dir = old_dir
+		return err
+	}
+
+	return os.Remove(old_path)
+}
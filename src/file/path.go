@@ -0,0 +1,146 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// the longest file name most filesystems allow, in bytes
+const MaxNameLength = 255
+
+// names windows won't create a file with, with or without an extension
+var reserved_names = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+var ErrUnsafePath = errors.New("file path can't be made safe")
+
+// make a single path element from a torrent safe to create on any
+// filesystem. separators, control characters and characters windows
+// doesn't allow are replaced, reserved names are prefixed and long names
+// are shortened. an empty result means the element should be dropped
+func SanitiseName(name string) string {
+	name = strings.ToValidUTF8(name, "_")
+
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`/\<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	// windows drops trailing dots and spaces, which could turn two
+	// names into one
+	name = strings.TrimSpace(name)
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return ""
+	}
+
+	base := strings.ToUpper(name)
+	if i := strings.Index(base, "."); i >= 0 {
+		base = base[:i]
+	}
+	if reserved_names[base] {
+		name = "_" + name
+	}
+
+	return shorten(name, MaxNameLength)
+}
+
+// sanitise every element of a path relative to the torrent. . and ..
+// elements and elements that end up empty are dropped, so the path can't
+// leave the torrents directory. a path with nothing left is unsafe
+func SanitisePath(elements []string) ([]string, error) {
+	path := make([]string, 0, len(elements))
+	for _, element := range elements {
+		if element == "." || element == ".." {
+			continue
+		}
+		if name := SanitiseName(element); name != "" {
+			path = append(path, name)
+		}
+	}
+
+	if len(path) == 0 {
+		return nil, ErrUnsafePath
+	}
+
+	return path, nil
+}
+
+// rename files whose paths clash with another file, or with a directory
+// another file is in. case is ignored, as it is on some filesystems
+func MakeUnique(files []*File) {
+	dirs := make(map[string]bool)
+	for _, f := range files {
+		for i := 1; i < len(f.path); i++ {
+			dirs[pathKey(f.path[:i])] = true
+		}
+	}
+
+	taken := make(map[string]bool)
+	for _, f := range files {
+		if f.IsPadding() {
+			continue
+		}
+
+		name := f.path[len(f.path)-1]
+		for n := 1; taken[pathKey(f.path)] || dirs[pathKey(f.path)]; n++ {
+			f.path[len(f.path)-1] = numbered(name, n)
+		}
+		taken[pathKey(f.path)] = true
+	}
+}
+
+func pathKey(path []string) string {
+	return strings.ToLower(filepath.Join(path...))
+}
+
+// name with a number before its extension, such as name.1.ext
+func numbered(name string, n int) string {
+	suffix := fmt.Sprintf(".%d", n)
+	ext := filepath.Ext(name)
+	// an extension too long to leave room for the number is dropped
+	if ext == name || len(suffix)+len(ext) >= MaxNameLength {
+		ext = ""
+	}
+
+	base := shorten(strings.TrimSuffix(name, ext), MaxNameLength-len(suffix)-len(ext))
+
+	return base + suffix + ext
+}
+
+// cut name down to length bytes without splitting a character, keeping
+// its extension if it's short enough to leave room for the rest
+func shorten(name string, length int) string {
+	if length < 0 {
+		length = 0
+	}
+	if len(name) <= length {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	if len(ext) > length/2 || ext == name {
+		ext = ""
+	}
+
+	base := name[:len(name)-len(ext)]
+	end := length - len(ext)
+	if end < 0 {
+		end = 0
+	}
+	for end > 0 && utf8.RuneStart(base[end]) == false {
+		end--
+	}
+
+	return base[:end] + ext
+}
@@ -0,0 +1,68 @@
+package file
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitisePath(t *testing.T) {
+	path, err := SanitisePath([]string{"..", "a/b", ".", "CON.txt", "c. "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a_b", "_CON.txt", "c"}
+	if strings.Join(path, "|") != strings.Join(want, "|") {
+		t.Errorf("path = %q, want %q", path, want)
+	}
+
+	if _, err := SanitisePath([]string{"..", "."}); err != ErrUnsafePath {
+		t.Errorf("error = %v, want %v", err, ErrUnsafePath)
+	}
+}
+
+func TestMakeUnique(t *testing.T) {
+	files := []*File{
+		NewFile(1, []string{"dir", "Name.txt"}),
+		NewFile(1, []string{"dir", "name.TXT"}),
+		NewFile(1, []string{"dir"}),
+	}
+	MakeUnique(files)
+
+	want := []string{"dir/Name.txt", "dir/name.1.TXT", "dir.1"}
+	for i, f := range files {
+		if strings.Join(f.path, "/") != want[i] {
+			t.Errorf("file %d = %q, want %q", i, strings.Join(f.path, "/"), want[i])
+		}
+	}
+}
+
+// names whose extension leaves no room for a number
+func TestMakeUniqueLongExtension(t *testing.T) {
+	name := "a." + strings.Repeat("x", MaxNameLength-2)
+	files := []*File{
+		NewFile(1, []string{name}),
+		NewFile(1, []string{name}),
+	}
+	MakeUnique(files)
+
+	renamed := files[1].path[0]
+	if renamed == name {
+		t.Errorf("clashing name wasn't changed")
+	}
+	if len(renamed) > MaxNameLength {
+		t.Errorf("renamed to %d bytes, longer than %d", len(renamed), MaxNameLength)
+	}
+}
+
+func TestShorten(t *testing.T) {
+	if got := shorten("abc", -1); got != "" {
+		t.Errorf("shorten to -1 = %q, want \"\"", got)
+	}
+	// a multi byte character isn't split
+	if got := shorten("aé", 2); got != "a" {
+		t.Errorf("shorten = %q, want %q", got, "a")
+	}
+	if got := shorten(strings.Repeat("x", 300)+".mkv", 20); got != strings.Repeat("x", 16)+".mkv" {
+		t.Errorf("shorten kept %q", got)
+	}
+}
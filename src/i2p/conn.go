@@ -0,0 +1,44 @@
+package i2p
+
+import (
+	"bufio"
+	"net"
+)
+
+// the address of an i2p destination
+type Addr struct {
+	destination string
+}
+
+func NewAddr(destination string) *Addr {
+	return &Addr{destination}
+}
+
+func (a *Addr) Network() string {
+	return "i2p"
+}
+
+func (a *Addr) String() string {
+	return a.destination
+}
+
+// a stream to another destination. the bridge may have sent part of the
+// stream along with its reply, so reads go through the reply's reader
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+	local  *Addr
+	remote *Addr
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
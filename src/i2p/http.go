@@ -0,0 +1,25 @@
+package i2p
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// an http client for .i2p hosts, such as i2p trackers. ports mean nothing
+// to i2p so they're dropped
+func (s *Session) HttpClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					host = address
+				}
+				return s.Dial(host, timeout)
+			},
+		},
+	}
+}
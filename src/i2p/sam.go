@@ -0,0 +1,422 @@
+package i2p
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a streaming session with the sam bridge of an i2p router. the session
+// dials i2p destinations and, as a net.Listener, accepts connections to
+// our own destination
+// see: https://geti2p.net/en/docs/api/samv3
+type Session struct {
+	sam_address string
+	id          string
+	// the connection the session was created on. the session ends when
+	// it's closed
+	control     net.Conn
+	reader      *bufio.Reader
+	// our public destination, base64 encoded
+	destination string
+	// looked up names and b32 addresses
+	names       map[string]string
+	// the connection Accept is waiting on, closed along with the session
+	accepting   net.Conn
+	accept_lock sync.Mutex
+	closed      chan bool
+	lock        sync.Mutex
+}
+
+// i2p uses base64 with - and ~ in place of + and /
+var Encoding = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-~")
+
+// b32 addresses are the lowercase unpadded base32 of the sha256 hash of
+// the destination
+var b32_encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var ErrClosed = errors.New("i2p: session closed")
+
+// how long Accept waits before trying again when the bridge fails it,
+// doubling with each failure in a row up to max_accept_backoff
+var accept_backoff = time.Second
+var max_accept_backoff = 30 * time.Second
+
+// how long the bridge has to answer a command
+var command_timeout = 2 * time.Minute
+
+// the session peers and trackers use, set by the first call to NewSession
+var default_session *Session
+var default_lock sync.Mutex
+
+// create a session on the sam bridge at sam_address with a new transient
+// destination
+func NewSession(sam_address string, id string) (*Session, error) {
+	control, reader, err := hello(sam_address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := Session{}
+	s.sam_address = sam_address
+	s.id = id
+	s.control = control
+	s.reader = reader
+	s.names = make(map[string]string)
+	s.closed = make(chan bool)
+
+	// signature type 7 is ed25519, which every current router supports
+	reply, err := s.command("SESSION CREATE STYLE=STREAM ID=" + id + " DESTINATION=TRANSIENT SIGNATURE_TYPE=7")
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	if err := result(reply); err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	s.destination, err = s.Lookup("ME")
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	default_lock.Lock()
+	if default_session == nil {
+		default_session = &s
+	}
+	default_lock.Unlock()
+
+	return &s, nil
+}
+
+// the session i2p peers and trackers use, nil when i2p is off
+func Default() *Session {
+	default_lock.Lock()
+	defer default_lock.Unlock()
+
+	return default_session
+}
+
+// our destination, base64 encoded
+func (s *Session) Destination() string {
+	return s.destination
+}
+
+// resolve a name, such as a .i2p host, a .b32.i2p address or ME, to a
+// base64 destination. ME is only known to the sessions own connection,
+// other names are looked up on a connection of their own, so a slow
+// lookup can't leave a late reply on the session for the next one
+func (s *Session) Lookup(name string) (string, error) {
+	s.lock.Lock()
+	destination, ok := s.names[name]
+	s.lock.Unlock()
+	if ok {
+		return destination, nil
+	}
+
+	var reply string
+	var err error
+	if name == "ME" {
+		reply, err = s.command("NAMING LOOKUP NAME=ME")
+	} else {
+		reply, err = lookup(s.sam_address, name)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := result(reply); err != nil {
+		return "", err
+	}
+	if value(reply, "NAME") != name {
+		return "", errors.New("i2p: reply for the wrong name " + strings.TrimSpace(reply))
+	}
+
+	destination = value(reply, "VALUE")
+	if destination == "" {
+		return "", errors.New("i2p: no destination for " + name)
+	}
+
+	s.lock.Lock()
+	s.names[name] = destination
+	s.lock.Unlock()
+
+	return destination, nil
+}
+
+// open a stream to a destination, or to a name that resolves to one
+func (s *Session) Dial(destination string, timeout time.Duration) (net.Conn, error) {
+	if strings.HasSuffix(destination, ".i2p") {
+		var err error
+		destination, err = s.Lookup(destination)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conn, reader, err := hello(s.sam_address)
+	if err != nil {
+		return nil, err
+	}
+
+	// building tunnels to a new destination can take a while
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte("STREAM CONNECT ID=" + s.id + " DESTINATION=" + destination + " SILENT=false\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := result(reply); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &Conn{Conn: conn, reader: reader, local: &Addr{s.destination}, remote: &Addr{destination}}, nil
+}
+
+// wait for the next stream to our destination, making the session a
+// net.Listener. failures talking to the bridge are retried after a wait,
+// so Accept only returns an error once the session is closed
+func (s *Session) Accept() (net.Conn, error) {
+	backoff := accept_backoff
+	for {
+		select {
+		case <-s.closed:
+			return nil, ErrClosed
+		default:
+		}
+
+		conn, err := s.accept()
+		if err == nil {
+			return conn, nil
+		}
+
+		select {
+		case <-s.closed:
+			return nil, ErrClosed
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > max_accept_backoff {
+			backoff = max_accept_backoff
+		}
+	}
+}
+
+// ask the bridge for the next stream to our destination and wait for it
+func (s *Session) accept() (net.Conn, error) {
+	conn, reader, err := hello(s.sam_address)
+	if err != nil {
+		return nil, err
+	}
+
+	s.accept_lock.Lock()
+	select {
+	case <-s.closed:
+		s.accept_lock.Unlock()
+		conn.Close()
+		return nil, ErrClosed
+	default:
+	}
+	s.accepting = conn
+	s.accept_lock.Unlock()
+
+	defer func() {
+		s.accept_lock.Lock()
+		s.accepting = nil
+		s.accept_lock.Unlock()
+	}()
+
+	if _, err := conn.Write([]byte("STREAM ACCEPT ID=" + s.id + " SILENT=false\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := result(reply); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// once someone connects the bridge sends their destination, followed
+	// by the stream
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	destination := strings.Fields(line)
+	if len(destination) == 0 {
+		conn.Close()
+		return nil, errors.New("i2p: no destination for accepted stream")
+	}
+
+	return &Conn{Conn: conn, reader: reader, local: &Addr{s.destination}, remote: &Addr{destination[0]}}, nil
+}
+
+func (s *Session) Addr() net.Addr {
+	return &Addr{s.destination}
+}
+
+func (s *Session) Close() error {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+		close(s.closed)
+	}
+
+	default_lock.Lock()
+	if default_session == s {
+		default_session = nil
+	}
+	default_lock.Unlock()
+
+	// stop waiting on a stream that will never come
+	s.accept_lock.Lock()
+	if s.accepting != nil {
+		s.accepting.Close()
+	}
+	s.accept_lock.Unlock()
+
+	return s.control.Close()
+}
+
+// send a command on the control connection and read the reply. if that
+// fails the connection can't be trusted to be in step with its replies,
+// so the session is closed
+func (s *Session) command(command string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.control.SetDeadline(time.Now().Add(command_timeout))
+	defer s.control.SetDeadline(time.Time{})
+
+	if _, err := s.control.Write([]byte(command + "\n")); err != nil {
+		s.Close()
+		return "", err
+	}
+
+	reply, err := s.reader.ReadString('\n')
+	if err != nil {
+		s.Close()
+		return "", err
+	}
+
+	return reply, nil
+}
+
+// look a name up on a new connection to the bridge
+func lookup(sam_address string, name string) (string, error) {
+	conn, reader, err := hello(sam_address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(command_timeout))
+	if _, err := conn.Write([]byte("NAMING LOOKUP NAME=" + name + "\n")); err != nil {
+		return "", err
+	}
+
+	return reader.ReadString('\n')
+}
+
+// the b32 address of a 32 byte destination hash, as found in compact
+// peer lists
+func B32(hash []byte) string {
+	return strings.ToLower(b32_encoding.EncodeToString(hash)) + ".b32.i2p"
+}
+
+// the b32 address of a base64 destination
+func DestinationB32(destination string) (string, error) {
+	raw, err := Encoding.DecodeString(destination)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(raw)
+
+	return B32(hash[:]), nil
+}
+
+// connect to the bridge and agree on a version
+func hello(sam_address string) (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", sam_address, 10*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err := conn.Write([]byte("HELLO VERSION MIN=3.1 MAX=3.1\n")); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := result(reply); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, reader, nil
+}
+
+// the error in a reply, or nil if its RESULT is OK
+func result(reply string) error {
+	r := value(reply, "RESULT")
+	if r == "OK" {
+		return nil
+	}
+	if message := value(reply, "MESSAGE"); message != "" {
+		return errors.New("i2p: " + r + " " + message)
+	}
+	if r == "" {
+		return errors.New("i2p: unexpected reply " + strings.TrimSpace(reply))
+	}
+
+	return errors.New("i2p: " + r)
+}
+
+// the value of KEY=value in a reply. quoted values may contain spaces
+func value(reply string, key string) string {
+	reply = strings.TrimSpace(reply)
+	i := strings.Index(reply, " "+key+"=")
+	if i < 0 {
+		return ""
+	}
+	rest := reply[i+len(key)+2:]
+
+	if strings.HasPrefix(rest, "\"") {
+		if end := strings.Index(rest[1:], "\""); end >= 0 {
+			return rest[1 : end+1]
+		}
+		return rest[1:]
+	}
+	if end := strings.Index(rest, " "); end >= 0 {
+		return rest[:end]
+	}
+
+	return rest
+}
@@ -0,0 +1,276 @@
+package i2p
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const test_destination = "ourdestination~AAAA"
+const test_peer = "peerdestination-AAAA"
+
+// a stand in for the sam bridge of an i2p router. it answers just enough
+// of SAM v3 for a session: HELLO, SESSION CREATE, NAMING LOOKUP and
+// STREAM CONNECT and ACCEPT. the first fail_accepts accepts are refused
+type fakeBridge struct {
+	listener     net.Listener
+	names        map[string]string
+	fail_accepts int
+	lock         sync.Mutex
+}
+
+func newFakeBridge(t *testing.T) *fakeBridge {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &fakeBridge{listener: listener}
+	b.names = map[string]string{
+		"ME":          test_destination,
+		"tracker.i2p": test_peer,
+		"slow.i2p":    "slowdestination-AAAA",
+	}
+	go b.serve()
+
+	return b
+}
+
+func (b *fakeBridge) address() string {
+	return b.listener.Addr().String()
+}
+
+func (b *fakeBridge) close() {
+	b.listener.Close()
+}
+
+func (b *fakeBridge) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *fakeBridge) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return
+		}
+
+		switch fields[0] + " " + fields[1] {
+		case "HELLO VERSION":
+			io.WriteString(conn, "HELLO REPLY RESULT=OK VERSION=3.1\n")
+		case "SESSION CREATE":
+			io.WriteString(conn, "SESSION STATUS RESULT=OK DESTINATION=privatekeys\n")
+		case "NAMING LOOKUP":
+			name := value(line, "NAME")
+			// answered too late, after the lookup gave up on it
+			if name == "slow.i2p" {
+				time.Sleep(200 * time.Millisecond)
+			}
+			if destination, ok := b.names[name]; ok {
+				io.WriteString(conn, "NAMING REPLY RESULT=OK NAME="+name+" VALUE="+destination+"\n")
+			} else {
+				io.WriteString(conn, "NAMING REPLY RESULT=KEY_NOT_FOUND NAME="+name+"\n")
+			}
+		case "STREAM CONNECT":
+			if value(line, "DESTINATION") != test_peer {
+				io.WriteString(conn, "STREAM STATUS RESULT=CANT_REACH_PEER MESSAGE=\"no route\"\n")
+				return
+			}
+			io.WriteString(conn, "STREAM STATUS RESULT=OK\n")
+			// the stream echoes whatever is sent down it
+			io.Copy(conn, reader)
+			return
+		case "STREAM ACCEPT":
+			b.lock.Lock()
+			fail := b.fail_accepts > 0
+			b.fail_accepts--
+			b.lock.Unlock()
+			if fail {
+				io.WriteString(conn, "STREAM STATUS RESULT=I2P_ERROR MESSAGE=\"tunnels not ready\"\n")
+				return
+			}
+			io.WriteString(conn, "STREAM STATUS RESULT=OK\n")
+			io.WriteString(conn, test_peer+" FROM_PORT=0 TO_PORT=0\nhello")
+			io.Copy(ioutil.Discard, reader)
+			return
+		default:
+			return
+		}
+	}
+}
+
+func newTestSession(t *testing.T, b *fakeBridge) *Session {
+	s, err := NewSession(b.address(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestSessionCreate(t *testing.T) {
+	b := newFakeBridge(t)
+	defer b.close()
+
+	s := newTestSession(t, b)
+	defer s.Close()
+
+	if s.Destination() != test_destination {
+		t.Errorf("destination = %q, want %q", s.Destination(), test_destination)
+	}
+	if Default() != s {
+		t.Errorf("first session isn't the default")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	b := newFakeBridge(t)
+	defer b.close()
+
+	s := newTestSession(t, b)
+	defer s.Close()
+
+	destination, err := s.Lookup("tracker.i2p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if destination != test_peer {
+		t.Errorf("lookup = %q, want %q", destination, test_peer)
+	}
+
+	if _, err := s.Lookup("missing.i2p"); err == nil {
+		t.Errorf("lookup of an unknown name succeeded")
+	}
+}
+
+func TestLookupTimeout(t *testing.T) {
+	b := newFakeBridge(t)
+	defer b.close()
+
+	s := newTestSession(t, b)
+	defer s.Close()
+
+	command_timeout = 50 * time.Millisecond
+	defer func() { command_timeout = 2 * time.Minute }()
+
+	if _, err := s.Lookup("slow.i2p"); err == nil {
+		t.Errorf("lookup that timed out succeeded")
+	}
+
+	// the late reply doesn't get taken for the next lookups
+	time.Sleep(300 * time.Millisecond)
+	destination, err := s.Lookup("tracker.i2p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if destination != test_peer {
+		t.Errorf("lookup = %q, want %q", destination, test_peer)
+	}
+}
+
+func TestDial(t *testing.T) {
+	b := newFakeBridge(t)
+	defer b.close()
+
+	s := newTestSession(t, b)
+	defer s.Close()
+
+	conn, err := s.Dial("tracker.i2p", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if conn.RemoteAddr().String() != test_peer {
+		t.Errorf("remote address = %q, want %q", conn.RemoteAddr().String(), test_peer)
+	}
+
+	io.WriteString(conn, "ping")
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "ping" {
+		t.Errorf("echo = %q, want %q", reply, "ping")
+	}
+
+	if _, err := s.Dial("unreachable-AAAA", 5*time.Second); err == nil {
+		t.Errorf("dial of an unreachable destination succeeded")
+	}
+}
+
+func TestAccept(t *testing.T) {
+	b := newFakeBridge(t)
+	defer b.close()
+	// the first accepts fail and are retried
+	b.fail_accepts = 2
+	accept_backoff = 10 * time.Millisecond
+
+	s := newTestSession(t, b)
+	defer s.Close()
+
+	conn, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if conn.RemoteAddr().String() != test_peer {
+		t.Errorf("remote address = %q, want %q", conn.RemoteAddr().String(), test_peer)
+	}
+
+	// the stream begins right after the destination line
+	data := make([]byte, 5)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("stream = %q, want %q", data, "hello")
+	}
+}
+
+func TestAcceptClose(t *testing.T) {
+	b := newFakeBridge(t)
+	defer b.close()
+	// every accept fails, so Accept keeps retrying until it's closed
+	b.fail_accepts = 1 << 30
+	accept_backoff = 10 * time.Millisecond
+
+	s := newTestSession(t, b)
+
+	done := make(chan error)
+	go func() {
+		_, err := s.Accept()
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	s.Close()
+
+	select {
+	case err := <-done:
+		if err != ErrClosed {
+			t.Errorf("accept error = %v, want %v", err, ErrClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept didn't return after close")
+	}
+}
@@ -0,0 +1,268 @@
+package ipfilter
+
+import (
+	"../config"
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// blocks address ranges read from blocklist files. p2p, dat and cidr
+// formats are understood, and may be mixed in one file
+// p2p: "some description:1.2.3.0-1.2.3.255"
+// dat: "001.002.003.000 - 001.002.003.255 , 000 , some description"
+// cidr: "1.2.3.0/24" or a single address
+type Filter struct {
+	// sorted by start and not overlapping
+	ranges  []ipRange
+	blocked int64
+	// counts the times the ranges were replaced, so users of the filter
+	// can tell when to check their peers again
+	version int64
+	lock    sync.RWMutex
+}
+
+// addresses are kept in their 16 byte form so ipv4 and ipv6 ranges
+// can share a list
+type ipRange struct {
+	start net.IP
+	end   net.IP
+}
+
+// the filter every peer source checks
+var Default = NewFilter()
+
+func NewFilter() *Filter {
+	f := Filter{}
+
+	return &f
+}
+
+// replace the filters ranges with those in the configured files
+func (f *Filter) Reload() error {
+	return f.Load(config.IPFilterFiles)
+}
+
+// replace the filters ranges with those in the given files. if a file
+// can't be read the current ranges are kept
+func (f *Filter) Load(paths []string) error {
+	ranges := make([]ipRange, 0)
+	for _, path := range paths {
+		file_ranges, err := readFile(path)
+		if err != nil {
+			return err
+		}
+		ranges = append(ranges, file_ranges...)
+	}
+
+	ranges = merge(ranges)
+
+	f.lock.Lock()
+	f.ranges = ranges
+	f.lock.Unlock()
+	atomic.AddInt64(&f.version, 1)
+
+	return nil
+}
+
+// is the address blocked. every blocked address is counted
+func (f *Filter) IsBlocked(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+
+	f.lock.RLock()
+	ranges := f.ranges
+	f.lock.RUnlock()
+
+	// the last range starting at or before ip
+	i := sort.Search(len(ranges), func(i int) bool {
+		return bytes.Compare(ranges[i].start, ip) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(ip, ranges[i].end) > 0 {
+		return false
+	}
+
+	atomic.AddInt64(&f.blocked, 1)
+
+	return true
+}
+
+// is the address of a tcp or udp connection blocked
+func (f *Filter) IsBlockedAddr(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return f.IsBlocked(a.IP)
+	case *net.UDPAddr:
+		return f.IsBlocked(a.IP)
+	}
+
+	return false
+}
+
+// the number of connections and peers turned away
+func (f *Filter) GetBlocked() int64 {
+	return atomic.LoadInt64(&f.blocked)
+}
+
+// changes each time new ranges are loaded
+func (f *Filter) GetVersion() int64 {
+	return atomic.LoadInt64(&f.version)
+}
+
+// the number of address ranges loaded, after merging
+func (f *Filter) GetRanges() int {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return len(f.ranges)
+}
+
+func readFile(path string) ([]ipRange, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ranges := make([]ipRange, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if r, ok := parseLine(scanner.Text()); ok {
+			ranges = append(ranges, r)
+		}
+	}
+
+	return ranges, scanner.Err()
+}
+
+// parse a line of any of the supported formats. comments, blank lines and
+// lines that can't be parsed are skipped
+func parseLine(line string) (ipRange, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+		return ipRange{}, false
+	}
+
+	// a cidr block or single address
+	if _, ipnet, err := net.ParseCIDR(line); err == nil {
+		return netRange(ipnet), true
+	}
+	if ip := net.ParseIP(line); ip != nil {
+		return ipRange{start: ip.To16(), end: ip.To16()}, true
+	}
+
+	// dat, where an access level of 128 or more means the range is allowed
+	if parts := strings.Split(line, ","); len(parts) >= 2 {
+		level, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err == nil && level >= 128 {
+			return ipRange{}, false
+		}
+		if r, ok := parseRange(parts[0]); ok {
+			return r, true
+		}
+	}
+
+	// a bare range, or p2p where the description may itself contain colons
+	if r, ok := parseRange(line); ok {
+		return r, true
+	}
+	if i := strings.LastIndex(line, ":"); i >= 0 {
+		return parseRange(line[i+1:])
+	}
+
+	return ipRange{}, false
+}
+
+// parse "start - end"
+func parseRange(s string) (ipRange, bool) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return ipRange{}, false
+	}
+
+	start := parseIP(parts[0])
+	end := parseIP(parts[1])
+	if start == nil || end == nil || bytes.Compare(start, end) > 0 {
+		return ipRange{}, false
+	}
+
+	return ipRange{start: start, end: end}, true
+}
+
+// parse an address in its 16 byte form. dat files pad ipv4 octets
+// with zeros, which net.ParseIP won't accept
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ":") == false {
+		octets := strings.Split(s, ".")
+		for i, octet := range octets {
+			trimmed := strings.TrimLeft(octet, "0")
+			if trimmed == "" {
+				trimmed = "0"
+			}
+			octets[i] = trimmed
+		}
+		s = strings.Join(octets, ".")
+	}
+
+	return net.ParseIP(s).To16()
+}
+
+func netRange(ipnet *net.IPNet) ipRange {
+	start := ipnet.IP.To16()
+	mask := ipnet.Mask
+	if len(mask) == net.IPv4len {
+		// line the mask up with the last four bytes of the address
+		mask = append(net.CIDRMask(96, 128)[:12:12], mask...)
+	}
+
+	end := make(net.IP, net.IPv6len)
+	for i := range start {
+		end[i] = start[i] | ^mask[i]
+	}
+
+	return ipRange{start: start, end: end}
+}
+
+// sort ranges and merge any that overlap or touch
+func merge(ranges []ipRange) []ipRange {
+	sort.Slice(ranges, func(i int, j int) bool {
+		return bytes.Compare(ranges[i].start, ranges[j].start) < 0
+	})
+
+	merged := make([]ipRange, 0, len(ranges))
+	for _, r := range ranges {
+		last := len(merged) - 1
+		if last >= 0 && bytes.Compare(r.start, next(merged[last].end)) <= 0 {
+			if bytes.Compare(r.end, merged[last].end) > 0 {
+				merged[last].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+// the address after ip, or ip itself if it's the last one
+func next(ip net.IP) net.IP {
+	n := make(net.IP, len(ip))
+	copy(n, ip)
+	for i := len(n) - 1; i >= 0; i-- {
+		n[i]++
+		if n[i] != 0 {
+			return n
+		}
+	}
+
+	return ip
+}
@@ -0,0 +1,163 @@
+package listener
+
+import (
+	"../config"
+	"../i2p"
+	"../ipfilter"
+	"../mse"
+	"../peer"
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// accepts incoming peer connections on both ipv4 and ipv6, and from any
+// other listeners it's given (such as utp), reads their handshake and
+// hands them to the torrent with a matching info hash
+type Listener struct {
+	listeners []net.Listener
+	// chans of the torrents we accept peers for, keyed on info hash
+	torrents  map[string]chan *peer.Peer
+	lock      sync.Mutex
+}
+
+func NewListener() *Listener {
+	l := Listener{}
+	l.torrents = make(map[string]chan *peer.Peer)
+
+	return &l
+}
+
+// listen on the configured port. ipv4 and ipv6 get a socket each so
+// either can fail without taking the other down
+func (l *Listener) Listen() error {
+	networks := []string{"tcp4"}
+	if config.EnableIPv6 {
+		networks = append(networks, "tcp6")
+	}
+
+	var err error
+	for _, network := range networks {
+		var ln net.Listener
+		ln, err = net.Listen(network, net.JoinHostPort("", strconv.Itoa(config.ListenPort)))
+		if err != nil {
+			continue
+		}
+		l.listeners = append(l.listeners, ln)
+		go l.accept(ln)
+	}
+
+	if len(l.listeners) > 0 {
+		return nil
+	}
+
+	return err
+}
+
+// also accept peers from another kind of listener, such as a utp socket
+func (l *Listener) Serve(ln net.Listener) {
+	l.listeners = append(l.listeners, ln)
+	go l.accept(ln)
+}
+
+// accept peers for the torrent with the given info hash
+func (l *Listener) Register(hash []byte, peers chan *peer.Peer) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.torrents[string(hash)] = peers
+}
+
+func (l *Listener) accept(ln net.Listener) {
+	for {
+		connection, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		if ipfilter.Default.IsBlockedAddr(connection.RemoteAddr()) {
+			connection.Close()
+			continue
+		}
+
+		go l.handshake(connection)
+	}
+}
+
+// read the peers handshake and pass the connection on to its torrent.
+// a connection that doesn't start with a plaintext handshake is treated
+// as the start of an encrypted one. i2p streams are already encrypted end
+// to end, so they may always be plaintext
+// see: https://wiki.theory.org/BitTorrentSpecification#Handshake
+func (l *Listener) handshake(connection net.Conn) {
+	connection.SetReadDeadline(time.Now().Add(60 * time.Second))
+	reader := bufio.NewReader(connection)
+
+	start, err := reader.Peek(20)
+	if err != nil {
+		connection.Close()
+		return
+	}
+
+	plaintext := start[0] == 19 && bytes.Equal(start[1:20], []byte("BitTorrent protocol"))
+	_, over_i2p := connection.RemoteAddr().(*i2p.Addr)
+
+	var conn net.Conn
+	switch {
+	case plaintext && (config.EncryptionPolicy != "require" || over_i2p):
+		conn = mse.Wrap(connection, reader)
+	case plaintext == false && config.EncryptionPolicy == "require":
+		conn, _, err = mse.Accept(connection, reader, l.hashes(), mse.CryptoRC4)
+	case plaintext == false && config.EncryptionPolicy == "prefer":
+		conn, _, err = mse.Accept(connection, reader, l.hashes(), mse.CryptoRC4|mse.CryptoPlaintext)
+	default:
+		err = errors.New("connection refused by encryption policy")
+	}
+	if err != nil {
+		connection.Close()
+		return
+	}
+
+	result := make([]byte, 68)
+	connection.SetReadDeadline(time.Now().Add(60 * time.Second))
+	_, err = io.ReadFull(conn, result)
+	if err != nil || result[0] != 19 || bytes.Equal(result[1:20], []byte("BitTorrent protocol")) == false {
+		connection.Close()
+		return
+	}
+
+	l.lock.Lock()
+	peers, ok := l.torrents[string(result[28:48])]
+	l.lock.Unlock()
+
+	if ok == false {
+		connection.Close()
+		return
+	}
+
+	peers <- peer.NewIncomingPeer(conn, result)
+}
+
+// info hashes of every torrent we accept peers for
+func (l *Listener) hashes() [][]byte {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	hashes := make([][]byte, 0)
+	for hash := range l.torrents {
+		hashes = append(hashes, []byte(hash))
+	}
+
+	return hashes
+}
+
+func (l *Listener) Close() {
+	for _, ln := range l.listeners {
+		ln.Close()
+	}
+}
@@ -0,0 +1,252 @@
+package lsd
+
+import (
+	"../config"
+	"../ipfilter"
+	"../peer"
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// local service discovery multicast groups
+// see: http://bittorrent.org/beps/bep_0014.html
+const (
+	GroupIPv4 = "239.192.152.143:6771"
+	GroupIPv6 = "[ff15::efc0:988f]:6771"
+)
+
+// announces our torrents to the local network and hands peers that
+// announce the same torrents to their torrent
+type LSD struct {
+	groups   []*net.UDPAddr
+	// sockets joined to each group, and the sockets we send to it from.
+	// go turns off multicast loopback on joined sockets, so sending from
+	// a separate socket lets clients on the same machine find each other
+	conns    []*net.UDPConn
+	senders  []*net.UDPConn
+	// chans of the torrents we're announcing, keyed on info hash
+	torrents map[string]chan *peer.Peer
+	// sent with every announce so we can ignore our own
+	cookie   string
+	stop     chan bool
+	lock     sync.Mutex
+}
+
+func NewLSD() *LSD {
+	l := LSD{}
+	l.torrents = make(map[string]chan *peer.Peer)
+	l.cookie = fmt.Sprintf("uvg%08x", rand.Uint32())
+	l.stop = make(chan bool)
+
+	return &l
+}
+
+// announce the torrent with the given info hash, sending peers that
+// answer to the given chan
+func (l *LSD) Register(hash []byte, peers chan *peer.Peer) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.torrents[string(hash)] = peers
+}
+
+// join the multicast groups and start announcing
+func (l *LSD) Listen() error {
+	var ifi *net.Interface
+	if config.LSDInterface != "" {
+		var err error
+		ifi, err = net.InterfaceByName(config.LSDInterface)
+		if err != nil {
+			return err
+		}
+	}
+
+	groups := []string{GroupIPv4}
+	if config.EnableIPv6 {
+		groups = append(groups, GroupIPv6)
+	}
+
+	var err error
+	for _, group := range groups {
+		network := "udp4"
+		if strings.HasPrefix(group, "[") {
+			network = "udp6"
+		}
+
+		var addr *net.UDPAddr
+		addr, err = net.ResolveUDPAddr(network, group)
+		if err != nil {
+			continue
+		}
+
+		var conn *net.UDPConn
+		conn, err = net.ListenMulticastUDP(network, ifi, addr)
+		if err != nil {
+			continue
+		}
+
+		var sender *net.UDPConn
+		sender, err = net.ListenUDP(network, interfaceAddr(ifi, network))
+		if err != nil {
+			conn.Close()
+			continue
+		}
+
+		l.groups = append(l.groups, addr)
+		l.conns = append(l.conns, conn)
+		l.senders = append(l.senders, sender)
+		go l.receive(conn)
+	}
+
+	if len(l.conns) == 0 {
+		return err
+	}
+
+	go l.run()
+	return nil
+}
+
+// an address on the interface to send from, so multicast goes out on
+// that interface. nil lets the system pick
+func interfaceAddr(ifi *net.Interface, network string) *net.UDPAddr {
+	if ifi == nil {
+		return nil
+	}
+
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok == false {
+			continue
+		}
+		if (ipnet.IP.To4() != nil) == (network == "udp4") {
+			return &net.UDPAddr{IP: ipnet.IP, Zone: ifi.Name}
+		}
+	}
+
+	return nil
+}
+
+// announce every torrent now and then every LSDInterval seconds
+func (l *LSD) run() {
+	for {
+		l.announce()
+
+		select {
+		case <-l.stop:
+			return
+		case <-time.After(time.Duration(config.LSDInterval) * time.Second):
+		}
+	}
+}
+
+func (l *LSD) announce() {
+	l.lock.Lock()
+	hashes := make([][]byte, 0)
+	for hash := range l.torrents {
+		hashes = append(hashes, []byte(hash))
+	}
+	l.lock.Unlock()
+
+	if len(hashes) == 0 {
+		return
+	}
+
+	for i, group := range l.groups {
+		l.senders[i].WriteToUDP(l.Message(group.String(), hashes), group)
+	}
+}
+
+// build a BT-SEARCH announce for the given info hashes
+func (l *LSD) Message(host string, hashes [][]byte) []byte {
+	var buff bytes.Buffer
+	buff.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	buff.WriteString("Host: " + host + "\r\n")
+	buff.WriteString("Port: " + strconv.Itoa(config.ListenPort) + "\r\n")
+	for _, hash := range hashes {
+		buff.WriteString("Infohash: " + hex.EncodeToString(hash) + "\r\n")
+	}
+	buff.WriteString("cookie: " + l.cookie + "\r\n")
+	buff.WriteString("\r\n\r\n")
+
+	return buff.Bytes()
+}
+
+func (l *LSD) receive(conn *net.UDPConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		l.handleMessage(buf[:n], addr)
+	}
+}
+
+// parse an announce from another client on the network and hand the
+// peer to every torrent of ours it's announcing
+func (l *LSD) handleMessage(message []byte, addr *net.UDPAddr) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(message)))
+	if err != nil || req.Method != "BT-SEARCH" {
+		return
+	}
+
+	if req.Header.Get("Cookie") == l.cookie {
+		return
+	}
+
+	port, err := strconv.Atoi(req.Header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return
+	}
+
+	for _, hash_str := range req.Header["Infohash"] {
+		hash, err := hex.DecodeString(strings.TrimSpace(hash_str))
+		if err != nil {
+			continue
+		}
+
+		l.lock.Lock()
+		peers, ok := l.torrents[string(hash)]
+		l.lock.Unlock()
+
+		if ok && ipfilter.Default.IsBlocked(addr.IP) == false {
+			p := peer.NewPeer(addr.IP, uint16(port))
+			p.SetSource(peer.SourceLSD)
+			p.SetInfoHash(hash)
+			select {
+			case peers <- p:
+			default:
+			}
+		}
+	}
+}
+
+func (l *LSD) Close() {
+	select {
+	case <-l.stop:
+	default:
+		close(l.stop)
+	}
+
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	for _, sender := range l.senders {
+		sender.Close()
+	}
+}
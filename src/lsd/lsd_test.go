@@ -0,0 +1,97 @@
+package lsd
+
+import (
+	"../config"
+	"../peer"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+var wanted_hash = bytes.Repeat([]byte{0xab}, 20)
+var other_hash = bytes.Repeat([]byte{0xcd}, 20)
+
+// a node receiving announces on a loopback socket rather than the
+// multicast group, which isn't always available to tests
+func newReceiver(t *testing.T) (*LSD, *net.UDPConn, chan *peer.Peer) {
+	l := NewLSD()
+	peers := make(chan *peer.Peer, 10)
+	l.Register(wanted_hash, peers)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.conns = append(l.conns, conn)
+	go l.receive(conn)
+
+	return l, conn, peers
+}
+
+func send(t *testing.T, to *net.UDPConn, message []byte) {
+	sender, err := net.DialUDP("udp4", nil, to.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	if _, err := sender.Write(message); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectNoPeer(t *testing.T, peers chan *peer.Peer) {
+	select {
+	case p := <-peers:
+		t.Errorf("unexpected peer %s", p.GetAddr())
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestAnnounceReceived(t *testing.T) {
+	receiver, conn, peers := newReceiver(t)
+	defer receiver.Close()
+
+	announcer := NewLSD()
+	send(t, conn, announcer.Message(GroupIPv4, [][]byte{other_hash, wanted_hash}))
+
+	select {
+	case p := <-peers:
+		address := p.GetAddress()
+		if address.IP.Equal(net.IPv4(127, 0, 0, 1)) == false || int(address.Port) != config.ListenPort {
+			t.Errorf("peer address = %s, want 127.0.0.1:%d", p.GetAddr(), config.ListenPort)
+		}
+		if bytes.Equal(p.GetInfoHash(), wanted_hash) == false {
+			t.Errorf("peer info hash = %x, want %x", p.GetInfoHash(), wanted_hash)
+		}
+		if p.GetSource() != peer.SourceLSD {
+			t.Errorf("peer source = %d, want %d", p.GetSource(), peer.SourceLSD)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("announce wasn't received")
+	}
+
+	// the hash we don't have is filtered out
+	expectNoPeer(t, peers)
+}
+
+func TestOwnAnnounceIgnored(t *testing.T) {
+	receiver, conn, peers := newReceiver(t)
+	defer receiver.Close()
+
+	// our own announce, recognised by its cookie
+	send(t, conn, receiver.Message(GroupIPv4, [][]byte{wanted_hash}))
+
+	expectNoPeer(t, peers)
+}
+
+func TestOtherTorrentIgnored(t *testing.T) {
+	receiver, conn, peers := newReceiver(t)
+	defer receiver.Close()
+
+	announcer := NewLSD()
+	send(t, conn, announcer.Message(GroupIPv4, [][]byte{other_hash}))
+
+	expectNoPeer(t, peers)
+}
@@ -0,0 +1,112 @@
+package merkle
+
+import (
+	"crypto/sha256"
+)
+
+// v2 torrents hash each file as a binary merkle tree of sha256 hashes,
+// with 16KiB blocks as its leaves. the leaf layer is padded to a power of
+// two with zero hashes
+// see: http://bittorrent.org/beps/bep_0052.html
+const BlockSize = 16 * 1024
+
+const HashSize = sha256.Size
+
+// the most hashes a peer will send in one hashes message
+const MaxHashes = 512
+
+// the leaf hashes of data, one per block. the last block may be short
+func HashBlocks(data []byte) [][]byte {
+	hashes := make([][]byte, 0, (len(data)+BlockSize-1)/BlockSize)
+	for start := 0; start < len(data); start += BlockSize {
+		end := start + BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha256.Sum256(data[start:end])
+		hashes = append(hashes, hash[:])
+	}
+
+	return hashes
+}
+
+// the root of a tree with width hashes in its bottom layer, of which the
+// ones past the end of hashes are padding. padding is the zero hash
+// raised to the height of the bottom layer
+func Root(hashes [][]byte, width int, height int) []byte {
+	layer := make([][]byte, width)
+	copy(layer, hashes)
+	pad := PadHash(height)
+	for i := len(hashes); i < width; i++ {
+		layer[i] = pad
+	}
+
+	for len(layer) > 1 {
+		next := make([][]byte, len(layer)/2)
+		for i := range next {
+			next[i] = pair(layer[2*i], layer[2*i+1])
+		}
+		layer = next
+		pad = pair(pad, pad)
+	}
+
+	if len(layer) == 0 {
+		return pad
+	}
+
+	return layer[0]
+}
+
+// the root of the whole tree, given the root of a subtree, its position
+// in its layer and the uncle hashes from there up
+func ProofRoot(hash []byte, position int, uncles [][]byte) []byte {
+	for _, uncle := range uncles {
+		if position%2 == 0 {
+			hash = pair(hash, uncle)
+		} else {
+			hash = pair(uncle, hash)
+		}
+		position /= 2
+	}
+
+	return hash
+}
+
+// the root of a subtree of 2^height zero leaves
+func PadHash(height int) []byte {
+	hash := make([]byte, HashSize)
+	for i := 0; i < height; i++ {
+		hash = pair(hash, hash)
+	}
+
+	return hash
+}
+
+// the smallest power of two at least n
+func NextPow2(n int) int {
+	pow := 1
+	for pow < n {
+		pow *= 2
+	}
+
+	return pow
+}
+
+// log2 of the smallest power of two at least n, the number of layers
+// above a bottom layer n hashes wide
+func Height(n int) int {
+	height := 0
+	for 1<<uint(height) < n {
+		height++
+	}
+
+	return height
+}
+
+func pair(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write(left)
+	h.Write(right)
+
+	return h.Sum(nil)
+}
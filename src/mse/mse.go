@@ -0,0 +1,366 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"time"
+)
+
+// message stream encryption, an obfuscated diffie hellman key exchange
+// followed by an rc4 (or plaintext) stream
+// see: http://wiki.vuze.com/w/Message_Stream_Encryption
+const (
+	CryptoPlaintext = uint32(0x01)
+	CryptoRC4       = uint32(0x02)
+
+	// the most padding either side may send
+	MaxPadLength = 512
+	// length of a diffie hellman public key
+	KeyLength = 96
+	// the whole key exchange must finish within this time
+	HandshakeTimeout = 30 * time.Second
+)
+
+var (
+	prime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+
+	// verification constant, eight zero bytes
+	vc = make([]byte, 8)
+
+	ErrNoSharedCrypto = errors.New("mse: no crypto method in common")
+	ErrUnknownHash    = errors.New("mse: peer asked for an unknown torrent")
+	ErrSync           = errors.New("mse: could not find the start of the encrypted stream")
+)
+
+// a connection that reads through a buffer (which may hold bytes read
+// during the handshake) and optionally rc4 encrypts and decrypts
+type Conn struct {
+	net.Conn
+	reader  io.Reader
+	encrypt *rc4.Cipher
+	decrypt *rc4.Cipher
+}
+
+// wrap a connection whose first bytes have already been read into r,
+// without any encryption
+func Wrap(conn net.Conn, r io.Reader) net.Conn {
+	return &Conn{Conn: conn, reader: r}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.reader.Read(b)
+	if c.decrypt != nil {
+		c.decrypt.XORKeyStream(b[:n], b[:n])
+	}
+
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.encrypt == nil {
+		return c.Conn.Write(b)
+	}
+
+	data := make([]byte, len(b))
+	c.encrypt.XORKeyStream(data, b)
+
+	return c.Conn.Write(data)
+}
+
+// run the key exchange as the connecting side. skey is the info hash of
+// the torrent we want. crypto_provide is the set of methods we'll accept
+func Initiate(conn net.Conn, skey []byte, crypto_provide uint32) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+
+	private, public, err := newKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	if _, err := conn.Write(append(public, randomPad()...)); err != nil {
+		return nil, err
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	yb := make([]byte, KeyLength)
+	if _, err := io.ReadFull(reader, yb); err != nil {
+		return nil, err
+	}
+	s := secret(private, yb)
+
+	encrypt := newCipher("keyA", s, skey)
+	decrypt := newCipher("keyB", s, skey)
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	var buff bytes.Buffer
+	buff.Write(hash([]byte("req1"), s))
+	buff.Write(xor(hash([]byte("req2"), skey), hash([]byte("req3"), s)))
+
+	var plain bytes.Buffer
+	plain.Write(vc)
+	binary.Write(&plain, binary.BigEndian, crypto_provide)
+	// no PadC and no initial payload, the bittorrent handshake follows
+	// once the exchange is finished
+	binary.Write(&plain, binary.BigEndian, uint16(0))
+	binary.Write(&plain, binary.BigEndian, uint16(0))
+
+	encrypted := make([]byte, plain.Len())
+	encrypt.XORKeyStream(encrypted, plain.Bytes())
+	buff.Write(encrypted)
+
+	if _, err := conn.Write(buff.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	// PadB comes first, so look for VC as it would look encrypted
+	encrypted_vc := make([]byte, len(vc))
+	newCipher("keyB", s, skey).XORKeyStream(encrypted_vc, vc)
+	if err := synchronize(reader, encrypted_vc, MaxPadLength); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(make([]byte, len(vc)), encrypted_vc)
+
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(header, header)
+
+	crypto_select := binary.BigEndian.Uint32(header[0:4])
+	pad_length := int(binary.BigEndian.Uint16(header[4:6]))
+	if pad_length > MaxPadLength {
+		return nil, errors.New("mse: padding too long")
+	}
+
+	pad := make([]byte, pad_length)
+	if _, err := io.ReadFull(reader, pad); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(pad, pad)
+
+	c := &Conn{Conn: conn, reader: reader}
+	switch {
+	case crypto_select == CryptoRC4 && crypto_provide&CryptoRC4 != 0:
+		c.encrypt = encrypt
+		c.decrypt = decrypt
+	case crypto_select == CryptoPlaintext && crypto_provide&CryptoPlaintext != 0:
+	default:
+		return nil, ErrNoSharedCrypto
+	}
+
+	return c, nil
+}
+
+// run the key exchange as the receiving side. r holds anything already
+// read from conn. skeys are the info hashes of the torrents we serve and
+// crypto_allowed the methods we'll agree to, rc4 preferred. the info
+// hash the peer asked for is returned along with the connection
+func Accept(conn net.Conn, r io.Reader, skeys [][]byte, crypto_allowed uint32) (net.Conn, []byte, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(r)
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	ya := make([]byte, KeyLength)
+	if _, err := io.ReadFull(reader, ya); err != nil {
+		return nil, nil, err
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	private, public, err := newKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := conn.Write(append(public, randomPad()...)); err != nil {
+		return nil, nil, err
+	}
+	s := secret(private, ya)
+
+	// 3 A->B: HASH('req1', S) follows PadA
+	if err := synchronize(reader, hash([]byte("req1"), s), MaxPadLength); err != nil {
+		return nil, nil, err
+	}
+
+	// HASH('req2', SKEY) xor HASH('req3', S) tells us the torrent
+	req := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(reader, req); err != nil {
+		return nil, nil, err
+	}
+	req2 := xor(req, hash([]byte("req3"), s))
+
+	var skey []byte
+	for _, key := range skeys {
+		if bytes.Equal(hash([]byte("req2"), key), req2) {
+			skey = key
+			break
+		}
+	}
+	if skey == nil {
+		return nil, nil, ErrUnknownHash
+	}
+
+	encrypt := newCipher("keyB", s, skey)
+	decrypt := newCipher("keyA", s, skey)
+
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	header := make([]byte, 14)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, err
+	}
+	decrypt.XORKeyStream(header, header)
+
+	if bytes.Equal(header[0:8], vc) == false {
+		return nil, nil, errors.New("mse: bad verification constant")
+	}
+	crypto_provide := binary.BigEndian.Uint32(header[8:12])
+	pad_length := int(binary.BigEndian.Uint16(header[12:14]))
+	if pad_length > MaxPadLength {
+		return nil, nil, errors.New("mse: padding too long")
+	}
+
+	pad := make([]byte, pad_length+2)
+	if _, err := io.ReadFull(reader, pad); err != nil {
+		return nil, nil, err
+	}
+	decrypt.XORKeyStream(pad, pad)
+
+	ia := make([]byte, binary.BigEndian.Uint16(pad[pad_length:]))
+	if _, err := io.ReadFull(reader, ia); err != nil {
+		return nil, nil, err
+	}
+	decrypt.XORKeyStream(ia, ia)
+
+	var crypto_select uint32
+	switch {
+	case crypto_provide&crypto_allowed&CryptoRC4 != 0:
+		crypto_select = CryptoRC4
+	case crypto_provide&crypto_allowed&CryptoPlaintext != 0:
+		crypto_select = CryptoPlaintext
+	default:
+		return nil, nil, ErrNoSharedCrypto
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	var plain bytes.Buffer
+	plain.Write(vc)
+	binary.Write(&plain, binary.BigEndian, crypto_select)
+	binary.Write(&plain, binary.BigEndian, uint16(0))
+
+	encrypted := make([]byte, plain.Len())
+	encrypt.XORKeyStream(encrypted, plain.Bytes())
+	if _, err := conn.Write(encrypted); err != nil {
+		return nil, nil, err
+	}
+
+	c := &Conn{Conn: conn, reader: reader}
+	if crypto_select == CryptoRC4 {
+		c.encrypt = encrypt
+		c.decrypt = decrypt
+	}
+
+	// the initial payload has already been decrypted, so it's read back
+	// ahead of the rest of the stream
+	return &Conn{Conn: c, reader: io.MultiReader(bytes.NewReader(ia), c)}, skey, nil
+}
+
+// generate a 160 bit private key and its public key, padded to 96 bytes
+func newKeys() (*big.Int, []byte, error) {
+	private_bytes := make([]byte, 20)
+	if _, err := rand.Read(private_bytes); err != nil {
+		return nil, nil, err
+	}
+	private := new(big.Int).SetBytes(private_bytes)
+
+	public := new(big.Int).Exp(generator, private, prime)
+
+	return private, pad(public.Bytes()), nil
+}
+
+// the shared secret S from our private key and their public key
+func secret(private *big.Int, public []byte) []byte {
+	s := new(big.Int).Exp(new(big.Int).SetBytes(public), private, prime)
+
+	return pad(s.Bytes())
+}
+
+// left pad a number to the length of a key
+func pad(b []byte) []byte {
+	padded := make([]byte, KeyLength)
+	copy(padded[KeyLength-len(b):], b)
+
+	return padded
+}
+
+// between 0 and 512 random bytes
+func randomPad() []byte {
+	length := make([]byte, 2)
+	rand.Read(length)
+
+	pad := make([]byte, int(binary.BigEndian.Uint16(length))%(MaxPadLength+1))
+	rand.Read(pad)
+
+	return pad
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+
+	return h.Sum(nil)
+}
+
+func xor(a []byte, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+
+	return result
+}
+
+// an rc4 cipher keyed with HASH(name, S, SKEY), with the first 1024
+// bytes of its keystream thrown away
+func newCipher(name string, s []byte, skey []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(name), s, skey))
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+
+	return c
+}
+
+// read from r until just past pattern, which must start within
+// max_skip bytes
+func synchronize(r *bufio.Reader, pattern []byte, max_skip int) error {
+	window := make([]byte, 0, max_skip+len(pattern))
+	for len(window) < max_skip+len(pattern) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+
+	return ErrSync
+}
@@ -0,0 +1,38 @@
+package peer
+
+import (
+	"../i2p"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// where a peer can be reached. tcp and utp peers have an ip and port,
+// i2p peers a destination instead
+type Address struct {
+	IP   net.IP
+	Port uint16
+	// a base64 i2p destination or a .b32.i2p address
+	Destination string
+}
+
+func (a Address) IsI2P() bool {
+	return a.Destination != ""
+}
+
+// host:port, or the b32 address of an i2p peer. used to tell peers
+// apart, so a peer that connected to us, which we know by its full
+// destination, matches the b32 address trackers gave us for it
+func (a Address) String() string {
+	if a.IsI2P() {
+		if strings.HasSuffix(a.Destination, ".i2p") {
+			return strings.ToLower(a.Destination)
+		}
+		if b32, err := i2p.DestinationB32(a.Destination); err == nil {
+			return b32
+		}
+		return a.Destination
+	}
+
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(int(a.Port)))
+}
@@ -2,7 +2,16 @@ package peer
 
 import (
 	"../chunk"
+	"../file"
+	"../i2p"
+	"../ipfilter"
+	"../merkle"
+	"../mse"
 	"../piece"
+	"../proxy"
+	"../ratelimit"
+	"../stats"
+	"../utp"
 	"bytes"
 	"config"
 	"encoding/binary"
@@ -15,11 +24,60 @@ import (
 	"time"
 )
 
+// message ids
+// see: https://wiki.theory.org/BitTorrentSpecification
+// and: http://bittorrent.org/beps/bep_0006.html
+// and: http://bittorrent.org/beps/bep_0052.html
+const (
+	MSG_CHOKE          = int8(0)
+	MSG_UNCHOKE        = int8(1)
+	MSG_INTERESTED     = int8(2)
+	MSG_NOT_INTERESTED = int8(3)
+	MSG_HAVE           = int8(4)
+	MSG_BITFIELD       = int8(5)
+	MSG_REQUEST        = int8(6)
+	MSG_PIECE          = int8(7)
+	MSG_CANCEL         = int8(8)
+	MSG_PORT           = int8(9)
+	MSG_SUGGEST        = int8(13)
+	MSG_HAVE_ALL       = int8(14)
+	MSG_HAVE_NONE      = int8(15)
+	MSG_REJECT         = int8(16)
+	MSG_ALLOWED_FAST   = int8(17)
+	MSG_METADATA       = int8(20)
+	MSG_HASH_REQUEST   = int8(21)
+	MSG_HASHES         = int8(22)
+	MSG_HASH_REJECT    = int8(23)
+)
+
+// the most suggested pieces we keep track of
+const MaxSuggested = 16
+
+// where we heard about a peer
+const (
+	SourceTracker  = 0
+	SourceLSD      = 1
+	// the other address of a peer we're connected to
+	SourceAlt      = 2
+	SourceIncoming = 3
+	// the x.pe param of the magnet link
+	SourceMagnet   = 4
+)
+
 type Peer struct {
-	ip                       		net.IP
-	port                     		uint16
+	address                  		Address
 	connection               		net.Conn
 	connected                		bool
+	// did the peer connect to us
+	incoming                 		bool
+	// the peers other address, from the ipv6 or ipv4 field of its
+	// extended handshake
+	alt_ip                   		net.IP
+	listen_port              		uint16
+	source                   		int
+	// the info hash of the swarm we found the peer in. hybrid torrents
+	// have a v1 and a v2 swarm. nil for the torrents main hash
+	info_hash                		[]byte
 	closed                   		bool
 	handshaked               		bool
 	choked 				 			bool
@@ -34,32 +92,209 @@ type Peer struct {
 	// bitfield containing the pieces this peer has available for download
 	bitfield                 		*bitfield.Bitfield
 
+	// did both of us set the fast extension bit in our handshakes
+	fast                     		bool
+	// the peer sent have all or have none in place of a bitfield
+	have_all                 		bool
+	have_none                		bool
+	// pieces announced with have after a have none
+	have                     		map[int]bool
+	// pieces the peer will serve us while we're choked
+	allowed_fast             		map[int]bool
+	// pieces the peer suggested, tried before any others
+	suggested                		[]int
+
+	// the peer set the v2 bit in its handshake, so it can send us the
+	// piece layers of v2 files
+	v2                       		bool
+	// the file whose piece layer we're asking for, starting at which of
+	// its pieces, and whether the request has gone out
+	hash_file                		*file.File
+	hash_index               		int
+	hash_sent                		bool
+	// the peer rejected a hash request or never answered, don't ask again
+	hash_rejected            		bool
 
 	// channel for receiving new chunks from the torrent object
 	chunk_chan 				 		chan *chunk.Chunk
 	// the chunk i'm currently working on
 	chunk      				 		*chunk.Chunk
+
+	// when the outstanding chunk was requested and when the peer last
+	// delivered piece data
+	requested_at             		time.Time
+	last_data                		time.Time
+	// the peer hasn't delivered data in SnubTimeout seconds
+	snubbed                  		bool
+
+	// have we told the peer we're interested, does the peer have pieces
+	// we still need, and has the peer told us it's interested
+	interested               		bool
+	wanted                   		bool
+	peer_interested          		bool
+	// when neither side became interested in the other
+	uninterested_since       		time.Time
+	// when we last sent anything, and when a message other than a
+	// keep-alive last went either way
+	last_sent                		time.Time
+	last_activity            		time.Time
+
+	// the torrents byte counters
+	stats                    		*stats.Stats
+	// buckets our reads and writes are throttled by
+	download_limits          		[]*ratelimit.Bucket
+	upload_limits            		[]*ratelimit.Bucket
 }
 
 func NewPeer(ip net.IP, port uint16) *Peer {
+	return NewPeerAt(Address{IP: ip, Port: port})
+}
+
+// a peer at any kind of address, such as an i2p destination
+func NewPeerAt(address Address) *Peer {
 	p := Peer{}
-	p.ip = ip
-	p.port = port
+	p.address = address
 	p.choked = true
 	p.bitfield = bitfield.NewBitfield(true, 1)
+	p.have = make(map[int]bool)
+	p.allowed_fast = make(map[int]bool)
+	p.wanted = true
 	p.chunk_chan = make(chan *chunk.Chunk, 1)
+	p.stats = stats.NewStats()
 
 	return &p
 }
 
+// wrap a connection accepted by the listener. the peers handshake has
+// already been read, so only ours is sent when the peer runs
+func NewIncomingPeer(connection net.Conn, handshake []byte) *Peer {
+	var p *Peer
+	switch addr := connection.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		p = NewPeer(addr.IP, uint16(addr.Port))
+	case *net.UDPAddr:
+		p = NewPeer(addr.IP, uint16(addr.Port))
+	case *i2p.Addr:
+		p = NewPeerAt(Address{Destination: addr.String()})
+	default:
+		p = NewPeer(net.IPv4zero, 0)
+	}
+
+	p.connection = connection
+	p.connected = true
+	p.incoming = true
+	p.source = SourceIncoming
+	p.fast = supportsFast(handshake)
+	p.v2 = supportsV2(handshake)
+	if len(handshake) >= 48 {
+		p.info_hash = append([]byte{}, handshake[28:48]...)
+	}
+
+	return p
+}
+
+// does a handshake have the fast extension bit set, and do we want it
+// see: http://bittorrent.org/beps/bep_0006.html
+func supportsFast(handshake []byte) bool {
+	return config.EnableFastExtension && len(handshake) >= 28 && handshake[27]&0x04 != 0
+}
+
+// does a handshake have the v2 bit set
+// see: http://bittorrent.org/beps/bep_0052.html
+func supportsV2(handshake []byte) bool {
+	return len(handshake) >= 28 && handshake[27]&0x10 != 0
+}
+
+// the first global unicast ipv6 address of this machine, or nil
+func LocalIPv6() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok == false {
+			continue
+		}
+		ip := ipnet.IP
+		if ip.To4() == nil && ip.IsGlobalUnicast() && ip.IsPrivate() == false {
+			return ip
+		}
+	}
+
+	return nil
+}
+
+// a second address the peer told us it can be reached on, which the
+// torrent can connect to as a separate peer. nil if there isn't one
+func (p *Peer) GetAltPeer() *Peer {
+	if p.address.IsI2P() || p.alt_ip == nil || p.listen_port == 0 || p.alt_ip.Equal(p.address.IP) {
+		return nil
+	}
+	if ipfilter.Default.IsBlocked(p.alt_ip) {
+		return nil
+	}
+
+	alt := NewPeer(p.alt_ip, p.listen_port)
+	alt.source = SourceAlt
+
+	return alt
+}
+
+func (p *Peer) SetStats(s *stats.Stats) {
+	p.stats = s
+}
+
+// throttle the connection by these buckets once it's made
+func (p *Peer) SetLimits(download []*ratelimit.Bucket, upload []*ratelimit.Bucket) {
+	p.download_limits = download
+	p.upload_limits = upload
+}
+
+func (p *Peer) SetSource(source int) {
+	p.source = source
+}
+
+func (p *Peer) GetSource() int {
+	return p.source
+}
+
+func (p *Peer) SetInfoHash(hash []byte) {
+	p.info_hash = hash
+}
+
+// the hash of the swarm the peer is in, nil for the torrents main hash
+func (p *Peer) GetInfoHash() []byte {
+	return p.info_hash
+}
+
+func (p *Peer) GetAddress() Address {
+	return p.address
+}
+
 func (p *Peer) IsConnected() bool {
 	return p.connected
 }
 
+func (p *Peer) IsClosed() bool {
+	return p.closed
+}
+
+// the peers address as host:port or an i2p destination, used to tell
+// peers apart
+func (p *Peer) GetAddr() string {
+	return p.address.String()
+}
+
 func (p *Peer) IsChoked() bool {
 	return p.choked
 }
 
+func (p *Peer) IsSnubbed() bool {
+	return p.snubbed
+}
+
 func (p *Peer) IsMetadataLoaded() bool {
 	metadata_piece_size := int64(config.ChunkSize)
 	metadata_pieces := p.metadata_size/metadata_piece_size + 1
@@ -80,7 +315,10 @@ func (p *Peer) CanRequestMetadata() bool {
 // available chunk belonging to a piece this peer has available
 // for download
 func (p *Peer) GetChunkFromTorrent(request_chunk chan *Peer) {
-	if p.IsMetadataLoaded() && p.IsChoked() == false && p.connected && p.handshaked {
+	// a peer we aren't interested in is asked again so we can tell it
+	// once it has something we need
+	can_download := p.IsChoked() == false || len(p.allowed_fast) > 0 || p.interested == false
+	if p.IsMetadataLoaded() && can_download && p.connected && p.handshaked {
 		// ask the torrent to call ClaimChunk at the next available opportunity
 		request_chunk <- p
 		select {
@@ -88,51 +326,212 @@ func (p *Peer) GetChunkFromTorrent(request_chunk chan *Peer) {
 			p.chunk = ch
 			p.sent_chunk_req = false
 		}
+		p.updateInterest()
 	}
 }
 
 // after calling GetChunkFromTorrent the torrent object
 // calls this function, allowing the peer to select the 
 // next available chunk in the main goroutine, unblocking
-// the peer
+// the peer. pieces the peer suggested are tried first. if there's
+// nothing to claim the peer is sent nil and waits for the next
+// message that could change that
 func (p *Peer) ClaimChunk(pieces []*piece.Piece) {
-	if p.IsChoked() == false && p.connected && p.handshaked {
-		for i, pi := range pieces {
-			// if peer has piece
-			if pi.IsDownloadable() == true {
-				if int64(i) > p.bitfield.Size() || p.bitfield.GetBit(i) {
-					ch := pi.GetNextChunk()
-
-					if ch != nil {
-						p.chunk_chan <- ch
-						return
-					}
+	var ch *chunk.Chunk
+
+	if p.connected && p.handshaked {
+		for _, i := range p.suggested {
+			if ch == nil && i < len(pieces) {
+				ch = p.claimFromPiece(pieces[i], i)
+			}
+		}
+		// pieces of higher priority files come first. snubbed peers work
+		// from the back so a slow peer doesn't hold up the pieces needed next
+		for priority := file.PriorityHigh; priority > file.PrioritySkip && ch == nil; priority-- {
+			for n := range pieces {
+				i := n
+				if p.snubbed {
+					i = len(pieces) - 1 - n
+				}
+				if ch == nil && pieces[i].GetPriority() == priority {
+					ch = p.claimFromPiece(pieces[i], i)
 				}
 			}
 		}
+
+		p.wanted = ch != nil || p.hasNeededPiece(pieces)
 	}
+
+	p.chunk_chan <- ch
+}
+
+// the next chunk of a piece, if the peer has it and will serve it to us.
+// a v2 piece we can't verify yet isn't downloaded, instead we ask the
+// peer for its files piece layer
+func (p *Peer) claimFromPiece(pi *piece.Piece, i int) *chunk.Chunk {
+	if pi.IsDownloadable() && p.HasPiece(i) && (p.IsChoked() == false || p.allowed_fast[i]) {
+		if pi.HasHash() == false {
+			p.claimHashes(pi, i)
+			return nil
+		}
+		return pi.GetNextChunk()
+	}
+
+	return nil
+}
+
+// take on asking for the part of a piece layer that covers piece i, if
+// the peer can give it to us and isn't already asking for one
+func (p *Peer) claimHashes(pi *piece.Piece, i int) {
+	f := pi.GetMerkleFile()
+	if f == nil || p.v2 == false || p.hash_rejected || p.hash_file != nil {
+		return
+	}
+
+	start, _ := f.GetStartAndEndPieces()
+	p.hash_file = f
+	p.hash_index = (i - int(start)) / merkle.MaxHashes * merkle.MaxHashes
+	p.hash_sent = false
+}
+
+// does the peer have any piece we still need, whether or not all of
+// its chunks are taken
+func (p *Peer) hasNeededPiece(pieces []*piece.Piece) bool {
+	for i, pi := range pieces {
+		if pi.IsDownloadable() && pi.IsValid() == false && p.HasPiece(i) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// does the peer have a piece available for download
+func (p *Peer) HasPiece(i int) bool {
+	if p.have_all {
+		return true
+	}
+	if p.have_none {
+		return p.have[i]
+	}
+
+	return int64(i) > p.bitfield.Size() || p.bitfield.GetBit(i)
 }
 
 // establish a connection with the peer
-func (p *Peer) Connect() {
-	var err error
-	p.connection, err = net.Dial("tcp", p.ip.String()+":"+fmt.Sprintf("%d", p.port))
+// the connection is encrypted according to the encryption policy. when
+// encryption is only preferred and the peer won't do it, we reconnect
+// and speak plaintext instead. i2p streams are already encrypted end to
+// end, so they never are
+func (p *Peer) Connect(hash []byte) {
+	if p.address.IsI2P() == false && p.address.IP.To4() == nil && config.EnableIPv6 == false {
+		p.closed = true
+		return
+	}
+
+	connection, err := p.dial()
 	if err != nil {
 		p.closed = true
 		return
 	}
 
+	policy := config.EncryptionPolicy
+	if p.address.IsI2P() {
+		policy = "disabled"
+	}
+
+	switch policy {
+	case "require":
+		p.connection, err = mse.Initiate(connection, hash, mse.CryptoRC4)
+		if err != nil {
+			connection.Close()
+			p.closed = true
+			return
+		}
+	case "prefer":
+		p.connection, err = mse.Initiate(connection, hash, mse.CryptoRC4|mse.CryptoPlaintext)
+		if err != nil {
+			connection.Close()
+			p.connection, err = p.dial()
+			if err != nil {
+				p.closed = true
+				return
+			}
+		}
+	default:
+		p.connection = connection
+	}
+
 	p.connected = true
 }
 
+// dial the peer over the transports allowed by the transport
+// preference, in order, until one connects
+func (p *Peer) dial() (net.Conn, error) {
+	if p.address.IsI2P() {
+		session := i2p.Default()
+		if session == nil {
+			return nil, fmt.Errorf("i2p is disabled, can't dial %s", p.GetAddr())
+		}
+		return session.Dial(p.address.Destination, 2*time.Minute)
+	}
+
+	transports := []string{"tcp"}
+	switch config.TransportPreference {
+	case "utp":
+		transports = []string{"utp"}
+	case "prefer_utp":
+		transports = []string{"utp", "tcp"}
+	case "prefer_tcp":
+		transports = []string{"tcp", "utp"}
+	}
+
+	var connection net.Conn
+	err := fmt.Errorf("no transport allowed to dial %s", p.GetAddr())
+	for _, transport := range transports {
+		// utp can't go through a proxy
+		if transport == "utp" && (proxy.Enabled() || proxy.Only()) {
+			continue
+		} else if transport == "utp" {
+			// most peers don't speak utp, so when there's tcp to fall back
+			// to utp only gets long enough to retransmit its syn once,
+			// rather than holding a half open slot for the full timeout
+			timeout := 10 * time.Second
+			if transports[len(transports)-1] != "utp" {
+				timeout = utp.SynTimeout + time.Second
+			}
+			connection, err = utp.Dial(p.GetAddr(), timeout)
+		} else if p.address.IP.To4() == nil {
+			connection, err = proxy.Dial("tcp6", p.GetAddr(), 10*time.Second)
+		} else {
+			connection, err = proxy.Dial("tcp4", p.GetAddr(), 10*time.Second)
+		}
+
+		if err == nil {
+			return connection, nil
+		}
+	}
+
+	return nil, err
+}
+
 // send extended handshake to peer
 // see: http://www.rasterbar.com/products/libtorrent/extension_protocol.html
 func (p *Peer) Handshake(hash []byte) {
+	if len(p.download_limits) > 0 || len(p.upload_limits) > 0 {
+		p.connection = ratelimit.NewConn(p.connection, p.download_limits, p.upload_limits)
+	}
+
 	// send regular handshake
 	var pstrlen int8
 	pstrlen = 19
 	pstr := "BitTorrent protocol"
 	reserved := [8]byte{0, 0, 0, 0, 0, 16, 0, 0}
+	if config.EnableFastExtension {
+		reserved[7] |= 0x04
+	}
+	// we can verify v2 pieces
+	reserved[7] |= 0x10
 	peer_id := "UVG01234567891234567"
 
 	var buff bytes.Buffer
@@ -142,29 +541,119 @@ func (p *Peer) Handshake(hash []byte) {
 	binary.Write(&buff, binary.BigEndian, hash)
 	binary.Write(&buff, binary.BigEndian, []byte(peer_id))
 
-	p.connection.Write(buff.Bytes())
+	p.write(buff.Bytes())
 
-	result := make([]byte, 68)
-	p.connection.SetReadDeadline(time.Now().Add(60 * time.Second))
-	_, err := p.connection.Read(result)
-	if err != nil {
-		return
+	// the listener has already read an incoming peers handshake
+	if p.incoming == false {
+		result := make([]byte, 68)
+		p.connection.SetReadDeadline(time.Now().Add(60 * time.Second))
+		_, err := io.ReadFull(p.connection, result)
+		if err != nil {
+			p.Close()
+			return
+		}
+		p.fast = supportsFast(result)
+		p.v2 = supportsV2(result)
 	}
 
 	p.handshaked = true
+	p.last_data = time.Now()
+
+	// with the fast extension a bitfield message is required, we have
+	// nothing to share yet
+	if p.fast {
+		p.sendMessage(MSG_HAVE_NONE)
+	}
 
 	// send extended handshake
 	buff.Reset()
-	metadata_message := "d1:md11:ut_metadatai1eee"
+	metadata_message := p.extendedHandshake()
 	binary.Write(&buff, binary.BigEndian, uint32(len(metadata_message)+2))
 	binary.Write(&buff, binary.BigEndian, uint8(20))
 	binary.Write(&buff, binary.BigEndian, uint8(0))
 	binary.Write(&buff, binary.BigEndian, []byte(metadata_message))
-	p.connection.Write(buff.Bytes())
+	p.write(buff.Bytes())
 
 	p.SendInterested()
 }
 
+// the bencoded extended handshake. as well as the extensions we support
+// it carries our listen port and, if we have one, our ipv6 address so
+// ipv4 peers can also reach us over ipv6
+func (p *Peer) extendedHandshake() string {
+	handshake := map[string]interface{}{
+		"m": map[string]interface{}{
+			"ut_metadata": 1,
+		},
+		"p": config.ListenPort,
+	}
+
+	if config.EnableIPv6 && proxy.Enabled() == false && p.address.IsI2P() == false {
+		if ip := LocalIPv6(); ip != nil {
+			handshake["ipv6"] = string(ip.To16())
+		}
+	}
+
+	message, err := bencode.EncodeString(handshake)
+	if err != nil {
+		return "d1:md11:ut_metadatai1eee"
+	}
+
+	return message
+}
+
+// write to the peer, keeping track of when we last sent anything.
+// anything longer than a keep-alive counts as activity
+func (p *Peer) write(b []byte) (int, error) {
+	p.last_sent = time.Now()
+	if len(b) > 4 {
+		p.last_activity = p.last_sent
+	}
+
+	return p.connection.Write(b)
+}
+
+// a zero length message, sent so the peer doesn't drop a quiet connection
+// see: https://wiki.theory.org/BitTorrentSpecification#keep-alive:_.3Clen.3D0000.3E
+func (p *Peer) SendKeepAlive() {
+	p.write(make([]byte, 4))
+}
+
+// tell the peer whether we still want pieces from it when that changes
+func (p *Peer) updateInterest() {
+	if p.wanted && p.interested == false {
+		p.SendInterested()
+	} else if p.wanted == false && p.interested {
+		p.sendMessage(MSG_NOT_INTERESTED)
+		p.interested = false
+		p.checkInterest()
+	}
+}
+
+// note when neither side became interested in the other
+func (p *Peer) checkInterest() {
+	if p.interested || p.peer_interested {
+		p.uninterested_since = time.Time{}
+	} else if p.uninterested_since.IsZero() {
+		p.uninterested_since = time.Now()
+	}
+}
+
+// should the connection be closed. it is when nothing but keep-alives
+// has gone either way for IdleTimeout seconds, or neither side has been
+// interested in the other for UninterestedTimeout seconds
+func (p *Peer) IsIdle() bool {
+	if config.IdleTimeout > 0 && time.Since(p.last_activity) >= time.Duration(config.IdleTimeout)*time.Second {
+		return true
+	}
+	if p.uninterested_since.IsZero() == false &&
+		time.Since(p.uninterested_since) >= time.Duration(config.UninterestedTimeout)*time.Second {
+		return true
+	}
+
+	return false
+}
+
 // tell the peer i'm looking for pieces
 // see: https://wiki.theory.org/BitTorrentSpecification
 func (p *Peer) SendInterested() {
@@ -175,32 +664,107 @@ func (p *Peer) SendInterested() {
 	binary.Write(&buff, binary.BigEndian, msg_len)
 	binary.Write(&buff, binary.BigEndian, msg_id)
 
-	p.connection.Write(buff.Bytes())
+	p.write(buff.Bytes())
+	p.interested = true
+	p.checkInterest()
+}
+
+// send a message made of an id and a payload
+// see: https://wiki.theory.org/BitTorrentSpecification
+func (p *Peer) sendMessage(msg_id int8, payload ...byte) {
+	var buff bytes.Buffer
+	binary.Write(&buff, binary.BigEndian, int32(len(payload)+1))
+	binary.Write(&buff, binary.BigEndian, msg_id)
+	binary.Write(&buff, binary.BigEndian, payload)
+
+	p.write(buff.Bytes())
 }
 
 // request a chunk from a peer
 // see: https://wiki.theory.org/BitTorrentSpecification
 func (p *Peer) SendChunkRequest() {
 	if p.sent_chunk_req == false {
-		chunk_size := int64(config.ChunkSize)
-		msg_length := int32(13)
-		msg_id := int8(6)
+		p.sendMessage(MSG_REQUEST, p.chunkRequest()...)
+		p.sent_chunk_req = true
+		p.requested_at = time.Now()
+	}
+}
 
-		index := int32(p.chunk.GetPieceIndex())
-		begin := int32(chunk_size * p.chunk.GetIndex())
-		piece_length := int32(p.chunk.GetLength())
+// the index, begin and length of the claimed chunk, as requests and
+// cancels give them
+func (p *Peer) chunkRequest() []byte {
+	var buff bytes.Buffer
+	binary.Write(&buff, binary.BigEndian, int32(p.chunk.GetPieceIndex()))
+	binary.Write(&buff, binary.BigEndian, int32(int64(config.ChunkSize)*p.chunk.GetIndex()))
+	binary.Write(&buff, binary.BigEndian, int32(p.chunk.GetLength()))
 
-		var buff bytes.Buffer
-		binary.Write(&buff, binary.BigEndian, msg_length)
-		binary.Write(&buff, binary.LittleEndian, msg_id)
-		binary.Write(&buff, binary.BigEndian, index)
-		binary.Write(&buff, binary.BigEndian, begin)
-		binary.Write(&buff, binary.BigEndian, piece_length)
-		p.connection.Write(buff.Bytes())
-		p.sent_chunk_req = true
+	return buff.Bytes()
+}
+
+// the hash request for the piece layer part we've claimed. the layer is
+// padded to a power of two and asked for up to MaxHashes at a time, with
+// the uncle hashes needed to check the part against the files root
+func (p *Peer) hashRequest() []byte {
+	pieces := merkle.NextPow2(p.hash_file.GetPieceCount())
+	length := pieces
+	if length > merkle.MaxHashes {
+		length = merkle.MaxHashes
+	}
+	base_layer := merkle.Height(int(p.hash_file.GetPieceLength() / merkle.BlockSize))
+	proof_layers := merkle.Height(pieces) - merkle.Height(length)
+
+	var buff bytes.Buffer
+	binary.Write(&buff, binary.BigEndian, p.hash_file.GetPiecesRoot())
+	binary.Write(&buff, binary.BigEndian, uint32(base_layer))
+	binary.Write(&buff, binary.BigEndian, uint32(p.hash_index))
+	binary.Write(&buff, binary.BigEndian, uint32(length))
+	binary.Write(&buff, binary.BigEndian, uint32(proof_layers))
+
+	return buff.Bytes()
+}
+
+// ask for the piece layer part we've claimed
+// see: http://bittorrent.org/beps/bep_0052.html
+func (p *Peer) SendHashRequest() {
+	if p.hash_sent == false {
+		p.sendMessage(MSG_HASH_REQUEST, p.hashRequest()...)
+		p.hash_sent = true
+		p.requested_at = time.Now()
 	}
 }
 
+// check the hashes the peer sent for the part we asked for against the
+// files root, keeping them if they match
+func (p *Peer) receiveHashes(message []byte) bool {
+	request := p.hashRequest()
+	if len(message) < len(request) || bytes.Equal(message[:len(request)], request) == false {
+		return false
+	}
+
+	length := int(binary.BigEndian.Uint32(request[40:44]))
+	proof_layers := int(binary.BigEndian.Uint32(request[44:48]))
+	hashes := message[len(request):]
+	if len(hashes) != (length+proof_layers)*merkle.HashSize {
+		return false
+	}
+
+	layer := make([][]byte, 0, length+proof_layers)
+	for i := 0; i < len(hashes); i += merkle.HashSize {
+		layer = append(layer, hashes[i:i+merkle.HashSize])
+	}
+
+	base_layer := int(binary.BigEndian.Uint32(request[32:36]))
+	root := merkle.Root(layer[:length], length, base_layer)
+	root = merkle.ProofRoot(root, p.hash_index/length, layer[length:])
+	if bytes.Equal(root, p.hash_file.GetPiecesRoot()) == false {
+		return false
+	}
+
+	p.hash_file.SetPieceHashes(p.hash_index, layer[:length])
+
+	return true
+}
+
 // send the extended metadata request
 // see: http://www.rasterbar.com/products/libtorrent/extension_protocol.html 
 func (p *Peer) RequestMetadata() {
@@ -217,7 +781,7 @@ func (p *Peer) RequestMetadata() {
 		binary.Write(&buff, binary.BigEndian, int8(20))
 		binary.Write(&buff, binary.BigEndian, int8(p.ut_metadata))
 		binary.Write(&buff, binary.BigEndian, []byte(bencoded_message))
-		p.connection.Write(buff.Bytes())
+		p.write(buff.Bytes())
 	}
 }
 
@@ -229,26 +793,40 @@ func (p *Peer) RequestMetadata() {
 // the function will spin off a new goroutine to repeat the process
 func (p *Peer) Run(hash []byte, metadata chan []byte, request_chunk chan *Peer) {
 	if p.IsConnected() == false && p.closed == false {
-		p.Connect()
+		p.Connect(hash)
 		if p.IsConnected() {
 			p.Handshake(hash)
 		}
+	} else if p.incoming && p.IsConnected() && p.handshaked == false {
+		p.Handshake(hash)
 	}
 
 	if p.IsConnected() && p.handshaked {
 		if p.chunk != nil && p.sent_chunk_req == false {
 			p.SendChunkRequest()
 		}
+		if p.hash_file != nil && p.hash_sent == false {
+			p.SendHashRequest()
+		}
 		err, req_chunk := p.HandleMessage(metadata, request_chunk)
 
 		if err == true {
 			if p.chunk != nil {
 				p.chunk.SetStatus(chunk.ChunkStatusReady)
+				p.chunk = nil
 			}
 		}
 		if req_chunk {
 			p.GetChunkFromTorrent(request_chunk)
 		}
+
+		if p.IsIdle() {
+			if p.chunk != nil {
+				p.chunk.SetStatus(chunk.ChunkStatusReady)
+				p.chunk = nil
+			}
+			p.Close()
+		}
 	}
 
 	if p.connected && p.handshaked {
@@ -266,7 +844,7 @@ func (p *Peer) HandleMessage(metadata chan []byte, request_chunk chan *Peer) (bo
 	var msg_length int32
 	length_bytes := make([]byte, 4)
 	length_bytes_read := 0
-	p.connection.SetReadDeadline(time.Now().Add(120 * time.Second))
+	p.connection.SetReadDeadline(p.readDeadline())
 
 	for length_bytes_read < len(length_bytes) {
 		n, err := p.connection.Read(length_bytes[length_bytes_read:4])
@@ -275,76 +853,148 @@ func (p *Peer) HandleMessage(metadata chan []byte, request_chunk chan *Peer) (bo
 				p.Close()
 				return true, false
 			}
+			// a quiet connection isn't an error, but a request may have
+			// timed out or a keep-alive may be due
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() && length_bytes_read == 0 {
+				if p.requestExpired() {
+					p.requestTimedOut()
+					return false, true
+				}
+				if p.keepAliveDue() {
+					p.SendKeepAlive()
+				}
+				return false, false
+			}
+			// we can't tell where the next message starts any more
+			p.Close()
 			return true, false
 		}
 		length_bytes_read += n
 	}
 	binary.Read(bytes.NewBuffer(length_bytes), binary.BigEndian, &msg_length)
 
-	if msg_length > 0 && msg_length < int32(config.ChunkSize+10000) {
+	if msg_length == 0 {
+		// keep-alive
+		return false, false
+	} else if msg_length > 0 && msg_length < int32(config.ChunkSize+10000) {
 		message := make([]byte, msg_length)
 		message_bytes_read := 0
+		// the rest of the message gets the full read timeout
+		p.connection.SetReadDeadline(time.Now().Add(120 * time.Second))
 
 		for int32(message_bytes_read) < msg_length {
 			n, err := p.connection.Read(message[message_bytes_read:msg_length])
 			if err != nil {
-				if err == io.EOF {
-					p.Close()
-					return true, false
-				}
+				// part of the message is lost, and with it our place in
+				// the stream
+				p.Close()
 				return true, false
 			}
 			message_bytes_read += n
 		}
-
-		const (
-			MSG_CHOKE          = int8(0)
-			MSG_UNCHOKE        = int8(1)
-			MSG_INTERESTED     = int8(2)
-			MSG_NOT_INTERESTED = int8(3)
-			MSG_HAVE           = int8(4)
-			MSG_BITFIELD       = int8(5)
-			MSG_REQUEST        = int8(6)
-			MSG_PIECE          = int8(7)
-			MSG_CANCEL         = int8(8)
-			MSG_PORT           = int8(9)
-			MSG_METADATA       = int8(20)
-		)
+		p.last_activity = time.Now()
 
 		var msg_id int8
 		binary.Read(bytes.NewBuffer(message[0:1]), binary.BigEndian, &msg_id)
 
 		if msg_id == MSG_CHOKE {
 			p.choked = true
+			// with the fast extension the peer rejects the requests it
+			// drops, so the chunk is kept until we hear back
+			if p.fast {
+				return false, false
+			}
 			return true, false
 		} else if msg_id == MSG_UNCHOKE {
 			p.choked = false
-			return false, true
+			return false, p.chunk == nil
 		} else if msg_id == MSG_INTERESTED {
+			p.peer_interested = true
+			p.checkInterest()
 		} else if msg_id == MSG_NOT_INTERESTED {
+			p.peer_interested = false
+			p.checkInterest()
 		} else if msg_id == MSG_HAVE {
 			var have_bit int32
 			binary.Read(bytes.NewBuffer(message[1:]), binary.BigEndian, &have_bit)
 
-			p.bitfield.SetBit(int(have_bit))
+			if p.have_none {
+				p.have[int(have_bit)] = true
+			} else {
+				p.bitfield.SetBit(int(have_bit))
+			}
+			return false, p.chunk == nil
 		} else if msg_id == MSG_BITFIELD {
 			p.bitfield.Copy(message[1:])
+			return false, p.chunk == nil
+		} else if msg_id == MSG_HAVE_ALL && p.fast {
+			p.have_all = true
+			return false, p.chunk == nil
+		} else if msg_id == MSG_HAVE_NONE && p.fast {
+			p.have_none = true
+		} else if msg_id == MSG_SUGGEST && p.fast && len(message) >= 5 {
+			index := int(binary.BigEndian.Uint32(message[1:5]))
+			if len(p.suggested) < MaxSuggested {
+				p.suggested = append(p.suggested, index)
+			}
+			return false, p.chunk == nil
+		} else if msg_id == MSG_ALLOWED_FAST && p.fast && len(message) >= 5 {
+			index := int(binary.BigEndian.Uint32(message[1:5]))
+			p.allowed_fast[index] = true
+			return false, p.chunk == nil
+		} else if msg_id == MSG_REJECT && p.fast && len(message) >= 13 {
+			// hand a rejected chunk straight back to the pool and ask
+			// for another
+			index := int64(binary.BigEndian.Uint32(message[1:5]))
+			begin := int64(binary.BigEndian.Uint32(message[5:9]))
+			length := int64(binary.BigEndian.Uint32(message[9:13]))
+			if p.chunk != nil && p.chunk.GetPieceIndex() == index &&
+				int64(config.ChunkSize)*p.chunk.GetIndex() == begin && p.chunk.GetLength() == length {
+				p.chunk.SetStatus(chunk.ChunkStatusReady)
+				p.chunk = nil
+				return false, true
+			}
 		} else if msg_id == MSG_REQUEST {
+			// we don't upload yet, say so rather than ignoring the request
+			if p.fast && len(message) >= 13 {
+				p.sendMessage(MSG_REJECT, message[1:13]...)
+			}
 		} else if msg_id == MSG_PIECE {
-			var piece_index int32
-			binary.Read(bytes.NewBuffer(message[1:]), binary.BigEndian, &piece_index)
 			if len(message) > 9 {
+				index := int64(binary.BigEndian.Uint32(message[1:5]))
+				begin := int64(binary.BigEndian.Uint32(message[5:9]))
 				data := message[9:]
-				if p.chunk != nil {
-					if len(data) == int(p.chunk.GetLength()) {
-						p.chunk.SetData(data)
-						p.chunk.SetStatus(chunk.ChunkStatusDone)
-						p.chunk = nil
-						return false, true
-					}
+				p.stats.AddDownloaded(int64(len(data)))
+				if p.chunk != nil && p.chunk.GetPieceIndex() == index &&
+					int64(config.ChunkSize)*p.chunk.GetIndex() == begin && len(data) == int(p.chunk.GetLength()) {
+					p.last_data = time.Now()
+					p.snubbed = false
+					p.chunk.SetData(data)
+					p.chunk.SetStatus(chunk.ChunkStatusDone)
+					p.chunk = nil
+					return false, true
 				}
 			}
-			return true, true
+			// a late answer to a request that timed out, or a block we
+			// never asked for. keep waiting for the one we did
+			return false, p.chunk == nil
+		} else if msg_id == MSG_HASHES && p.hash_file != nil && p.hash_sent {
+			// hashes that don't check out count as a rejection
+			if p.receiveHashes(message[1:]) == false {
+				p.hash_rejected = true
+			}
+			p.hash_file = nil
+			return false, p.chunk == nil
+		} else if msg_id == MSG_HASH_REJECT && p.hash_file != nil && p.hash_sent {
+			p.hash_rejected = true
+			p.hash_file = nil
+			return false, p.chunk == nil
+		} else if msg_id == MSG_HASH_REQUEST {
+			// we don't serve hashes yet either
+			if len(message) >= 49 {
+				p.sendMessage(MSG_HASH_REJECT, message[1:49]...)
+			}
+		} else if msg_id == MSG_HASHES || msg_id == MSG_HASH_REJECT {
 		} else if msg_id == MSG_CANCEL {
 		} else if msg_id == MSG_PORT {
 		} else if msg_id == MSG_METADATA {
@@ -361,6 +1011,14 @@ func (p *Peer) HandleMessage(metadata chan []byte, request_chunk chan *Peer) (bo
 					m := torrent["m"].(map[string]interface{})
 					p.ut_metadata = m["ut_metadata"].(int64)
 				}
+				if listen_port, ok := torrent["p"].(int64); ok && listen_port > 0 && listen_port <= 65535 {
+					p.listen_port = uint16(listen_port)
+				}
+				if ipv6, ok := torrent["ipv6"].(string); ok && len(ipv6) == net.IPv6len && p.address.IP.To4() != nil {
+					p.alt_ip = net.IP(ipv6)
+				} else if ipv4, ok := torrent["ipv4"].(string); ok && len(ipv4) == net.IPv4len && p.address.IP.To4() == nil {
+					p.alt_ip = net.IP(ipv4)
+				}
 
 				if p.CanRequestMetadata() {
 					p.RequestMetadata()
@@ -389,12 +1047,64 @@ func (p *Peer) HandleMessage(metadata chan []byte, request_chunk chan *Peer) (bo
 			return true, false
 		}
 	} else {
-		//p.Close()
+		// a message too long to be real, which we haven't read past
+		p.Close()
 		return true, false
 	}
 	return false, false
 }
 
+// wait for the next message no longer than the outstanding request
+// has left to run, or until the next keep-alive is due
+func (p *Peer) readDeadline() time.Time {
+	deadline := time.Now().Add(120 * time.Second)
+	if (p.chunk != nil && p.sent_chunk_req) || (p.hash_file != nil && p.hash_sent) {
+		request_deadline := p.requested_at.Add(time.Duration(config.RequestTimeout) * time.Second)
+		if request_deadline.Before(deadline) {
+			deadline = request_deadline
+		}
+	}
+
+	keep_alive_deadline := p.last_sent.Add(time.Duration(config.KeepAliveInterval) * time.Second)
+	if keep_alive_deadline.Before(deadline) {
+		deadline = keep_alive_deadline
+	}
+
+	return deadline
+}
+
+func (p *Peer) keepAliveDue() bool {
+	return time.Since(p.last_sent) >= time.Duration(config.KeepAliveInterval)*time.Second
+}
+
+func (p *Peer) requestExpired() bool {
+	timeout := time.Duration(config.RequestTimeout) * time.Second
+	outstanding := (p.chunk != nil && p.sent_chunk_req) || (p.hash_file != nil && p.hash_sent)
+	return outstanding && time.Since(p.requested_at) >= timeout
+}
+
+// hand the unanswered chunk back to the pool so another peer can have
+// it, and mark the peer snubbed if it's been quiet for too long. the peer
+// is told to cancel the request, so it doesn't send the chunk as well. a
+// peer that doesn't answer a hash request isn't asked again
+func (p *Peer) requestTimedOut() {
+	if p.hash_file != nil && p.hash_sent {
+		p.hash_rejected = true
+		p.hash_file = nil
+	}
+	if p.chunk != nil {
+		if p.sent_chunk_req {
+			p.sendMessage(MSG_CANCEL, p.chunkRequest()...)
+		}
+		p.chunk.SetStatus(chunk.ChunkStatusReady)
+		p.chunk = nil
+	}
+
+	if time.Since(p.last_data) >= time.Duration(config.SnubTimeout)*time.Second {
+		p.snubbed = true
+	}
+}
+
 func (p *Peer) Close() {
 	p.connected = false
 	p.handshaked = false
@@ -4,6 +4,7 @@ import (
 	"../chunk"
 	"../file"
 	"../config"
+	"../merkle"
 	"math"
 	"crypto/sha1"
 )
@@ -14,7 +15,18 @@ type Piece struct {
 	length          int64
 	hash            []byte
 	downloadable	bool
+	// the highest priority of the files the piece has data for
+	priority        file.Priority
 	valid           bool
+	// the files the piece was written to when it was verified, and the
+	// files whose part of it went to the part file instead
+	written         map[*file.File]bool
+	parked          map[*file.File]bool
+	part_file       *file.PartFile
+	// v2 pieces belong to a single file and are checked against its
+	// merkle tree, with the piece as a subtree leaves blocks wide
+	merkle_file     *file.File
+	leaves          int
 
 	chunks          []*chunk.Chunk
 	boundaries      map[*file.File]*Boundary
@@ -35,6 +47,8 @@ func NewPiece(index int64, length int64) *Piece {
 	p.downloadable = false
 
 	p.boundaries = make(map[*file.File]*Boundary)
+	p.written = make(map[*file.File]bool)
+	p.parked = make(map[*file.File]bool)
 
 	return &p
 }
@@ -43,7 +57,8 @@ func (p *Piece) InitChunks() {
 	p.length = p.length - p.bytes_remaining
 
 	chunk_size := int64(config.ChunkSize)
-	number_of_chunks := int64(Round(float64(p.length) / float64(chunk_size), 0.50, 0))
+	// a short last chunk still needs a chunk of its own
+	number_of_chunks := (p.length + chunk_size - 1) / chunk_size
 	last_chunk_size := p.length % chunk_size
 
 	for c := int64(0); c < number_of_chunks; c++ {
@@ -88,6 +103,24 @@ func (p *Piece) SetHash(hash []byte) {
 	p.hash = hash
 }
 
+// verify the piece as part of a v2 files merkle tree. without a hash set
+// the pieces hash comes from the files piece layer
+func (p *Piece) SetMerkle(f *file.File, leaves int) {
+	p.merkle_file = f
+	p.leaves = leaves
+}
+
+// the v2 file the piece belongs to, nil for v1 pieces
+func (p *Piece) GetMerkleFile() *file.File {
+	return p.merkle_file
+}
+
+// do we know what the piece should hash to. v2 pieces don't until we
+// have their files piece layer
+func (p *Piece) HasHash() bool {
+	return p.GetHash() != nil
+}
+
 func (p *Piece) SetDownloadable(downloadable bool) {
 	p.downloadable = downloadable
 }
@@ -96,7 +129,100 @@ func (p *Piece) IsDownloadable() bool {
 	return p.downloadable
 }
 
+func (p *Piece) GetPriority() file.Priority {
+	return p.priority
+}
+
+// where to keep the data of files we don't download
+func (p *Piece) SetPartFile(part_file *file.PartFile) {
+	p.part_file = part_file
+}
+
+// work out whether the piece is wanted, and how much, from the files it
+// has data for. a verified piece wasn't written to files that weren't
+// wanted then, so if one is now its data is restored from the part file,
+// or failing that the piece is downloaded again
+func (p *Piece) UpdatePriority() {
+	p.priority = file.PrioritySkip
+	for f := range p.boundaries {
+		if f.GetPriority() > p.priority {
+			p.priority = f.GetPriority()
+		}
+		if p.valid && f.IsDownloadable() && p.written[f] == false && p.restore(f) == false {
+			p.Reset()
+		}
+	}
+
+	p.downloadable = p.priority != file.PrioritySkip
+}
+
+// forget the piece was verified, so all its chunks are downloaded again
+func (p *Piece) Reset() {
+	p.valid = false
+	p.written = make(map[*file.File]bool)
+	p.parked = make(map[*file.File]bool)
+	for _, ch := range p.chunks {
+		ch.SetData([]byte{})
+		ch.SetStatus(chunk.ChunkStatusReady)
+	}
+}
+
+// copy a files part of the piece from the part file to the file
+func (p *Piece) restore(f *file.File) bool {
+	if p.parked[f] == false {
+		return false
+	}
+
+	b := p.boundaries[f]
+	data := make([]byte, b.Piece_end-b.Piece_start)
+	if err := p.part_file.ReadPiece(p.index, data, b.Piece_start); err != nil {
+		return false
+	}
+
+	if f.Write(data, b.File_start) != nil {
+		return false
+	}
+	p.written[f] = true
+
+	return true
+}
+
+func (p *Piece) IsValid() bool {
+	return p.valid
+}
+
+func (p *Piece) GetLength() int64 {
+	return p.length
+}
+
+// the number of bytes belonging to downloadable files that this
+// piece still has to provide
+func (p *Piece) GetBytesLeft() int64 {
+	if p.valid {
+		return 0
+	}
+
+	return p.GetBytesWanted()
+}
+
+// the number of bytes of this piece belonging to downloadable files
+func (p *Piece) GetBytesWanted() int64 {
+	wanted := int64(0)
+	for f, b := range p.boundaries {
+		if f.IsDownloadable() {
+			wanted += b.Piece_end - b.Piece_start
+		}
+	}
+
+	return wanted
+}
+
 func (p *Piece) GetHash() []byte {
+	if p.hash == nil && p.merkle_file != nil {
+		start, _ := p.merkle_file.GetStartAndEndPieces()
+		return p.merkle_file.GetPieceHash(int(p.index - start))
+	}
+
 	return p.hash
 }
 
@@ -115,7 +241,10 @@ func (p *Piece) GetNextChunk() *chunk.Chunk {
 	return nil
 }
 
-func (p *Piece) ChunksCount() (int, int, bool) {
+// the number of chunks done and in total, whether the piece is valid and
+// whether it just failed verification, in which case its chunks have been
+// reset for download. the error is from writing out a verified piece
+func (p *Piece) ChunksCount() (int, int, bool, bool, error) {
 	total_chunks := len(p.chunks)
 	completed_chunks := 0
 
@@ -126,16 +255,25 @@ func (p *Piece) ChunksCount() (int, int, bool) {
 	}
 
 	success := false
+	corrupt := false
+	var err error
 
 	if completed_chunks == total_chunks {
-		success = p.Verify()
+		success, corrupt, err = p.Verify()
 	}
 
-	return completed_chunks, total_chunks, success
+	return completed_chunks, total_chunks, success, corrupt, err
 }
 
-func (p *Piece) Verify() bool {
-	if p.valid == false {
+// check the piece against its hash, and write it out if it matches.
+// returns whether the piece is valid, and whether its data didn't match.
+// a v2 piece whose hash we don't have yet is neither, it waits for it.
+// a piece that can't be written isn't valid yet, it keeps its data to
+// be written again
+func (p *Piece) Verify() (bool, bool, error) {
+	corrupt := false
+	expected := p.GetHash()
+	if p.valid == false && expected != nil {
 		total_len := int64(0)
 
 		for _, ch := range p.chunks {
@@ -150,30 +288,50 @@ func (p *Piece) Verify() bool {
 			index += length
 		}
 
-		h := sha1.New()
-		h.Write(data)
-		hash := h.Sum(nil)
-		if string(hash) == string(p.hash) {
+		var hash []byte
+		if p.merkle_file != nil {
+			hash = merkle.Root(merkle.HashBlocks(data), p.leaves, 0)
+		} else {
+			h := sha1.New()
+			h.Write(data)
+			hash = h.Sum(nil)
+		}
+		if string(hash) == string(expected) {
+			if err := p.Write(data); err != nil {
+				return false, false, err
+			}
 			p.valid = true
-			p.Write(data)
 
 			for _, ch := range p.chunks {
 				ch.SetData([]byte{})
 			}
 		} else {
+			corrupt = true
 			for _, ch := range p.chunks {
 				ch.SetStatus(chunk.ChunkStatusReady)
 			}
 		}
 	}
 
-	return p.valid
+	return p.valid, corrupt, nil
 }
 
-func (p *Piece) Write(data []byte) {
+func (p *Piece) Write(data []byte) error {
 	for f, b := range p.boundaries {
-		f.Write(data[b.Piece_start:b.Piece_end], b.File_start)
+		if f.IsDownloadable() {
+			if err := f.Write(data[b.Piece_start:b.Piece_end], b.File_start); err != nil {
+				return err
+			}
+			p.written[f] = true
+		} else if f.IsPadding() == false && p.part_file != nil {
+			// padding is all zeros, so there's nothing to keep
+			if p.part_file.WritePiece(p.index, data[b.Piece_start:b.Piece_end], b.Piece_start) == nil {
+				p.parked[f] = true
+			}
+		}
 	}
+
+	return nil
 }
 
 func Round(val float64, roundOn float64, places int) float64 {
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"../config"
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// open a tunnel to address through an http proxy with CONNECT
+// see: https://tools.ietf.org/html/rfc7231#section-4.3.6
+func dialHttp(address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", config.ProxyAddress, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if config.ProxyUsername != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(config.ProxyUsername + ":" + config.ProxyPassword))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	request += "\r\n"
+
+	if _, err := conn.Write([]byte(request)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// the response is read a byte at a time so nothing the peer sends
+	// straight after it is swallowed by a buffer
+	reader := bufio.NewReaderSize(&byteReader{conn}, 16)
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+	}
+
+	// HTTP/1.1 200 Connection established
+	parts := strings.SplitN(strings.TrimSpace(status), " ", 3)
+	if len(parts) < 2 || parts[1] != "200" {
+		conn.Close()
+		return nil, errors.New("proxy: connect failed: " + strings.TrimSpace(status))
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// reads at most one byte at a time
+type byteReader struct {
+	conn net.Conn
+}
+
+func (r *byteReader) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+
+	return r.conn.Read(b)
+}
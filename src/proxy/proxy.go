@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"../config"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	ErrProxyOnly   = errors.New("proxy: direct connections are disabled in proxy only mode")
+	ErrUnsupported = errors.New("proxy: udp needs a socks5 proxy")
+)
+
+// is a proxy configured
+func Enabled() bool {
+	return config.ProxyType == "socks5" || config.ProxyType == "http"
+}
+
+// are connections that don't go through the proxy refused
+func Only() bool {
+	return config.ProxyOnly
+}
+
+// dial a tcp address through the configured proxy, or directly if there
+// isn't one and proxy only mode is off
+func Dial(network string, address string, timeout time.Duration) (net.Conn, error) {
+	switch config.ProxyType {
+	case "socks5":
+		return dialSocks5(address, timeout)
+	case "http":
+		return dialHttp(address, timeout)
+	}
+
+	if config.ProxyOnly {
+		return nil, ErrProxyOnly
+	}
+
+	return net.DialTimeout(network, address, timeout)
+}
+
+// a udp connection to address. through a socks5 proxy this is relayed
+// with udp associate, other proxies can't carry udp
+func DialUDP(network string, address string) (net.Conn, error) {
+	switch config.ProxyType {
+	case "socks5":
+		return dialSocks5UDP(address)
+	case "http":
+		if config.ProxyOnly {
+			return nil, ErrUnsupported
+		}
+	default:
+		if config.ProxyOnly {
+			return nil, ErrProxyOnly
+		}
+	}
+
+	return net.Dial(network, address)
+}
+
+// an http client whose requests go through the proxy. http proxies are
+// sent the requests themselves, socks5 proxies tunnel the connections
+func HttpClient(timeout time.Duration) *http.Client {
+	client := &http.Client{Timeout: timeout}
+
+	switch config.ProxyType {
+	case "socks5":
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				return dialSocks5(address, timeout)
+			},
+		}
+	case "http":
+		proxy_url := &url.URL{Scheme: "http", Host: config.ProxyAddress}
+		if config.ProxyUsername != "" {
+			proxy_url.User = url.UserPassword(config.ProxyUsername, config.ProxyPassword)
+		}
+		client.Transport = &http.Transport{Proxy: http.ProxyURL(proxy_url)}
+	default:
+		if config.ProxyOnly {
+			client.Transport = &http.Transport{
+				DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+					return nil, ErrProxyOnly
+				},
+			}
+		}
+	}
+
+	return client
+}
@@ -0,0 +1,306 @@
+package proxy
+
+import (
+	"../config"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// socks5 commands, address types and authentication methods
+// see: https://tools.ietf.org/html/rfc1928
+// and: https://tools.ietf.org/html/rfc1929
+const (
+	socksVersion = 5
+
+	socksConnect      = 1
+	socksUdpAssociate = 3
+
+	socksIPv4   = 1
+	socksDomain = 3
+	socksIPv6   = 4
+
+	socksNoAuth       = 0
+	socksPassword     = 2
+	socksNoAcceptable = 0xff
+)
+
+var socks_errors = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "ttl expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// connect to address through the socks5 proxy
+func dialSocks5(address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", config.ProxyAddress, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := socksAuthenticate(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := socksRequest(conn, socksConnect, address); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// a udp connection to address relayed by the socks5 proxy. the tcp
+// connection used to set it up has to stay open for as long as the
+// relay is used
+func dialSocks5UDP(address string) (net.Conn, error) {
+	control, err := net.DialTimeout("tcp", config.ProxyAddress, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	control.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if err := socksAuthenticate(control); err != nil {
+		control.Close()
+		return nil, err
+	}
+	// we don't know the address we'll send from, so it's left unspecified
+	relay, err := socksRequest(control, socksUdpAssociate, "0.0.0.0:0")
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	control.SetDeadline(time.Time{})
+
+	// a relay on an unspecified address is on the proxy itself
+	if relay.IP.IsUnspecified() {
+		host, _, _ := net.SplitHostPort(config.ProxyAddress)
+		ip, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			control.Close()
+			return nil, err
+		}
+		relay.IP = ip.IP
+	}
+
+	header, err := socksAddress(address)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	conn, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	// RSV, FRAG and the destination address
+	return &udpConn{Conn: conn, control: control, header: append([]byte{0, 0, 0}, header...)}, nil
+}
+
+// offer no authentication, and username and password if we have them
+func socksAuthenticate(conn net.Conn) error {
+	methods := []byte{socksNoAuth}
+	if config.ProxyUsername != "" {
+		methods = append(methods, socksPassword)
+	}
+
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return errors.New("proxy: not a socks5 proxy")
+	}
+
+	switch reply[1] {
+	case socksNoAuth:
+		return nil
+	case socksPassword:
+		request := []byte{1, byte(len(config.ProxyUsername))}
+		request = append(request, config.ProxyUsername...)
+		request = append(request, byte(len(config.ProxyPassword)))
+		request = append(request, config.ProxyPassword...)
+		if _, err := conn.Write(request); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("proxy: socks5 authentication failed")
+		}
+		return nil
+	}
+
+	return errors.New("proxy: no acceptable socks5 authentication method")
+}
+
+// send a request and return the address the proxy bound for it
+func socksRequest(conn net.Conn, command byte, address string) (*net.UDPAddr, error) {
+	addr, err := socksAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(append([]byte{socksVersion, command, 0}, addr...)); err != nil {
+		return nil, err
+	}
+
+	// VER, REP, RSV, ATYP
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	if reply[1] != 0 {
+		message, ok := socks_errors[reply[1]]
+		if ok == false {
+			message = "unknown error"
+		}
+		return nil, errors.New("proxy: socks5 " + message)
+	}
+
+	bound, err := readSocksAddress(conn, reply[3])
+	if err != nil {
+		return nil, err
+	}
+
+	return bound, nil
+}
+
+// encode host:port as ATYP, the address and the port. names are left for
+// the proxy to resolve so lookups don't leak
+func socksAddress(address string) ([]byte, error) {
+	host, port_str, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(port_str)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("proxy: bad port in " + address)
+	}
+
+	var addr []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, errors.New("proxy: host name too long")
+		}
+		addr = append([]byte{socksDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		addr = append([]byte{socksIPv4}, ip4...)
+	} else {
+		addr = append([]byte{socksIPv6}, ip.To16()...)
+	}
+
+	return append(addr, byte(port>>8), byte(port)), nil
+}
+
+// read an address and port of the given type
+func readSocksAddress(r io.Reader, address_type byte) (*net.UDPAddr, error) {
+	var ip net.IP
+	switch address_type {
+	case socksIPv4:
+		ip = make(net.IP, net.IPv4len)
+	case socksIPv6:
+		ip = make(net.IP, net.IPv6len)
+	case socksDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return nil, err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, err
+		}
+		resolved, err := net.ResolveIPAddr("ip", string(name))
+		if err != nil {
+			return nil, err
+		}
+		ip = resolved.IP
+	default:
+		return nil, errors.New("proxy: unknown socks5 address type")
+	}
+
+	if address_type != socksDomain {
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, err
+		}
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return nil, err
+	}
+
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port))}, nil
+}
+
+// a udp connection whose datagrams are wrapped in socks5 udp headers
+type udpConn struct {
+	net.Conn
+	control net.Conn
+	header  []byte
+}
+
+func (c *udpConn) Write(b []byte) (int, error) {
+	if _, err := c.Conn.Write(append(append([]byte{}, c.header...), b...)); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// read the next datagram, dropping fragments, which we don't reassemble
+func (c *udpConn) Read(b []byte) (int, error) {
+	buf := make([]byte, len(b)+262)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+
+		// skip RSV, FRAG, ATYP and the source address
+		start := 4
+		switch buf[3] {
+		case socksIPv4:
+			start += net.IPv4len
+		case socksIPv6:
+			start += net.IPv6len
+		case socksDomain:
+			start += 1 + int(buf[4])
+		default:
+			continue
+		}
+		start += 2
+		if start > n {
+			continue
+		}
+
+		return copy(b, buf[start:n]), nil
+	}
+}
+
+func (c *udpConn) Close() error {
+	c.control.Close()
+	return c.Conn.Close()
+}
@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// a token bucket earning rate bytes worth of tokens a second, holding at
+// most a seconds worth. a rate of 0 is unlimited
+type Bucket struct {
+	rate   int64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+func NewBucket(rate int64) *Bucket {
+	b := Bucket{}
+	b.rate = rate
+	b.tokens = float64(rate)
+	b.last = time.Now()
+
+	return &b
+}
+
+// change the rate in bytes a second, 0 for unlimited
+func (b *Bucket) SetRate(rate int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+	b.rate = rate
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+}
+
+func (b *Bucket) GetRate() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.rate
+}
+
+// take n bytes worth of tokens, sleeping until they've been earned. the
+// bucket may go into debt, so callers sharing it queue up behind each
+// other instead of being starved by smaller reads and writes
+func (b *Bucket) Wait(n int) {
+	b.lock.Lock()
+	if b.rate == 0 {
+		b.lock.Unlock()
+		return
+	}
+
+	b.refill()
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	rate := b.rate
+	b.lock.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / float64(rate) * float64(time.Second)))
+	}
+}
+
+// the most bytes to read or write at once so throughput stays smooth,
+// a quarter of a seconds worth. 0 when unlimited
+func (b *Bucket) burst() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.rate == 0 {
+		return 0
+	}
+	if b.rate < 4 {
+		return 1
+	}
+
+	return int(b.rate / 4)
+}
+
+func (b *Bucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > float64(b.rate) {
+		b.tokens = float64(b.rate)
+	}
+	b.last = now
+}
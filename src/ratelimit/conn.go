@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"net"
+)
+
+// a connection whose reads and writes are throttled by every one of its
+// download and upload buckets, such as the global ones and the torrents
+type Conn struct {
+	net.Conn
+	download []*Bucket
+	upload   []*Bucket
+}
+
+func NewConn(conn net.Conn, download []*Bucket, upload []*Bucket) net.Conn {
+	return &Conn{Conn: conn, download: download, upload: upload}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if max := smallestBurst(c.download); max > 0 && len(b) > max {
+		b = b[:max]
+	}
+
+	n, err := c.Conn.Read(b)
+	for _, bucket := range c.download {
+		bucket.Wait(n)
+	}
+
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		end := len(b)
+		if max := smallestBurst(c.upload); max > 0 && end-written > max {
+			end = written + max
+		}
+
+		for _, bucket := range c.upload {
+			bucket.Wait(end - written)
+		}
+
+		n, err := c.Conn.Write(b[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// the smallest burst of any limited bucket, 0 if none are limited
+func smallestBurst(buckets []*Bucket) int {
+	smallest := 0
+	for _, bucket := range buckets {
+		if burst := bucket.burst(); burst > 0 && (smallest == 0 || burst < smallest) {
+			smallest = burst
+		}
+	}
+
+	return smallest
+}
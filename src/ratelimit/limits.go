@@ -0,0 +1,133 @@
+package ratelimit
+
+import (
+	"../config"
+	"sync"
+	"time"
+)
+
+// the buckets every peer connection shares
+var (
+	GlobalDownload = NewBucket(0)
+	GlobalUpload   = NewBucket(0)
+)
+
+var (
+	// are the alternate limits switched on from the ui
+	alt_enabled bool
+	stop        chan bool
+	lock        sync.Mutex
+)
+
+// apply the configured global limits, and keep switching between the
+// normal and alternate limits as the schedule says until Stop
+func Start() {
+	lock.Lock()
+	stop = make(chan bool)
+	lock.Unlock()
+
+	apply()
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				apply()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func Stop() {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		stop = nil
+	}
+}
+
+// the global download and upload limits in KiB/s currently in force,
+// and whether they are the alternate ones
+func GetLimits() (int, int, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if altActive(time.Now()) {
+		return config.AltDownloadLimit, config.AltUploadLimit, true
+	}
+
+	return config.DownloadLimit, config.UploadLimit, false
+}
+
+// change the global limits in force, in KiB/s. 0 is unlimited
+func SetLimits(download int, upload int) {
+	lock.Lock()
+	if altActive(time.Now()) {
+		config.AltDownloadLimit = download
+		config.AltUploadLimit = upload
+	} else {
+		config.DownloadLimit = download
+		config.UploadLimit = upload
+	}
+	lock.Unlock()
+
+	apply()
+}
+
+// switch the alternate limits on or off
+func ToggleAlt() {
+	lock.Lock()
+	alt_enabled = !alt_enabled
+	lock.Unlock()
+
+	apply()
+}
+
+// bytes a second for a limit in KiB/s
+func KiB(limit int) int64 {
+	return int64(limit) * 1024
+}
+
+func apply() {
+	download, upload, _ := GetLimits()
+
+	GlobalDownload.SetRate(KiB(download))
+	GlobalUpload.SetRate(KiB(upload))
+}
+
+// are the alternate limits switched on, or is it within their schedule
+func altActive(now time.Time) bool {
+	if alt_enabled {
+		return true
+	}
+	if config.AltLimitsScheduled == false {
+		return false
+	}
+
+	from, err := time.Parse("15:04", config.AltLimitsFrom)
+	if err != nil {
+		return false
+	}
+	to, err := time.Parse("15:04", config.AltLimitsTo)
+	if err != nil {
+		return false
+	}
+
+	minute := now.Hour()*60 + now.Minute()
+	start := from.Hour()*60 + from.Minute()
+	end := to.Hour()*60 + to.Minute()
+
+	// a window like 22:00 to 06:00 runs past midnight
+	if start <= end {
+		return minute >= start && minute < end
+	}
+
+	return minute >= start || minute < end
+}
@@ -0,0 +1,61 @@
+package stats
+
+import (
+	"sync/atomic"
+)
+
+// before the metadata arrives we don't know how much is left, but telling
+// the trackers 0 would make us look like a seed
+const UnknownLeft = int64(16 * 1024)
+
+// byte counters for a torrent. peers, trackers and the ui all run in
+// their own goroutines, so every counter is read and written atomically
+type Stats struct {
+	downloaded int64
+	uploaded   int64
+	corrupt    int64
+	left       int64
+}
+
+func NewStats() *Stats {
+	s := Stats{}
+	s.left = UnknownLeft
+
+	return &s
+}
+
+// payload bytes received in piece messages
+func (s *Stats) AddDownloaded(n int64) {
+	atomic.AddInt64(&s.downloaded, n)
+}
+
+// payload bytes sent in piece messages
+func (s *Stats) AddUploaded(n int64) {
+	atomic.AddInt64(&s.uploaded, n)
+}
+
+// bytes of pieces that failed the hash check
+func (s *Stats) AddCorrupt(n int64) {
+	atomic.AddInt64(&s.corrupt, n)
+}
+
+// bytes of the selected files we still need
+func (s *Stats) SetLeft(n int64) {
+	atomic.StoreInt64(&s.left, n)
+}
+
+func (s *Stats) GetDownloaded() int64 {
+	return atomic.LoadInt64(&s.downloaded)
+}
+
+func (s *Stats) GetUploaded() int64 {
+	return atomic.LoadInt64(&s.uploaded)
+}
+
+func (s *Stats) GetCorrupt() int64 {
+	return atomic.LoadInt64(&s.corrupt)
+}
+
+func (s *Stats) GetLeft() int64 {
+	return atomic.LoadInt64(&s.left)
+}
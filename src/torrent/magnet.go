@@ -0,0 +1,181 @@
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// everything a magnet link can tell us about a torrent
+// see: http://bittorrent.org/beps/bep_0009.html#magnet-uri-format
+// and: http://bittorrent.org/beps/bep_0053.html
+type Magnet struct {
+	// the v1 and v2 info hashes. hybrid torrents have both
+	Hash     []byte
+	HashV2   []byte
+	// the dn param, empty if the link has none
+	Name     string
+	Trackers []string
+	// host:port addresses of peers to connect to directly
+	Peers    []string
+	// web seeds and exact sources. we can't download from either yet, but
+	// keep them so they aren't lost
+	WebSeeds []string
+	Sources  []string
+	// file indices to download, as inclusive ranges. nil if the link
+	// doesn't select any
+	Select   [][2]int
+}
+
+// parse a magnet uri. a link may have several xt params, for example one
+// per hash type, and we use the first btih and btmh ones
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("not a magnet uri: %q", uri)
+	}
+
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	m := Magnet{}
+	for _, xt := range query["xt"] {
+		if strings.HasPrefix(xt, "urn:btih:") && m.Hash == nil {
+			m.Hash, err = ParseInfoHash(strings.TrimPrefix(xt, "urn:btih:"))
+		} else if strings.HasPrefix(xt, "urn:btmh:") && m.HashV2 == nil {
+			m.HashV2, err = parseMultihash(strings.TrimPrefix(xt, "urn:btmh:"))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if m.Hash == nil && m.HashV2 == nil {
+		return nil, errors.New("magnet uri has no urn:btih: or urn:btmh: xt parameter")
+	}
+
+	if len(query["dn"]) > 0 {
+		m.Name = query["dn"][0]
+	}
+	m.Trackers = query["tr"]
+	m.Peers = query["x.pe"]
+	m.WebSeeds = query["ws"]
+	m.Sources = query["xs"]
+
+	if len(query["so"]) > 0 {
+		m.Select, err = parseSelectOnly(query["so"][0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &m, nil
+}
+
+// decode an info hash given as 40 hex or 32 base32 characters
+func ParseInfoHash(s string) ([]byte, error) {
+	var hash []byte
+	var err error
+	switch len(s) {
+	case 40:
+		hash, err = hex.DecodeString(s)
+	case 32:
+		hash, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		err = errors.New("wrong length")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid info hash %q: %v", s, err)
+	}
+
+	return hash, nil
+}
+
+// v2 info hashes are given as a hex multihash, which for sha256 is 1220
+// followed by the hash
+func parseMultihash(s string) ([]byte, error) {
+	multihash, err := hex.DecodeString(s)
+	if err != nil || len(multihash) != 34 || multihash[0] != 0x12 || multihash[1] != 0x20 {
+		return nil, fmt.Errorf("invalid v2 info hash %q", s)
+	}
+
+	return multihash[2:], nil
+}
+
+// the hashes of the swarms the torrent can be found in: the v1 hash and
+// the v2 hash truncated to 20 bytes, which is what v2 peers and trackers
+// use in its place
+func (m *Magnet) SwarmHashes() [][]byte {
+	hashes := make([][]byte, 0)
+	if m.Hash != nil {
+		hashes = append(hashes, m.Hash)
+	}
+	if m.HashV2 != nil {
+		hashes = append(hashes, m.HashV2[:20])
+	}
+
+	return hashes
+}
+
+// whether the link selects the file at index. every file is selected if
+// the link has no so param
+func (m *Magnet) Selects(index int) bool {
+	if m.Select == nil {
+		return true
+	}
+
+	for _, r := range m.Select {
+		if index >= r[0] && index <= r[1] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// the name to show until we have metadata: dn, or the hex info hash
+func (m *Magnet) DisplayName() string {
+	if m.Name != "" {
+		return m.Name
+	}
+	if m.Hash == nil {
+		return hex.EncodeToString(m.HashV2)
+	}
+
+	return hex.EncodeToString(m.Hash)
+}
+
+// parse a list of file indices and ranges, such as 0,2,4-6
+func parseSelectOnly(so string) ([][2]int, error) {
+	ranges := make([][2]int, 0)
+	for _, part := range strings.Split(so, ",") {
+		if part == "" {
+			continue
+		}
+
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid so parameter %q", so)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil || last < first {
+				return nil, fmt.Errorf("invalid so parameter %q", so)
+			}
+		}
+
+		ranges = append(ranges, [2]int{first, last})
+	}
+
+	return ranges, nil
+}
@@ -1,114 +1,322 @@
 package torrent
 
 import (
+	"../config"
+	"../connection"
 	"../file"
+	"../ipfilter"
+	"../merkle"
 	"../peer"
 	"../piece"
+	"../proxy"
+	"../ratelimit"
+	"../stats"
 	"../tracker"
 	"../ui"
 
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/zeebo/bencode"
-	"net/url"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Torrent struct {
 	Name               string
 	Hash               []byte
+	magnet             *Magnet
 	Trackers           []*tracker.Tracker
-	connected_trackers int
+	tiers              *tracker.Tiers
+	// the hashes of every swarm we're in, starting with Hash, and the
+	// tiers announcing to the swarms past the first. hybrid torrents are
+	// in both a v1 and a v2 swarm
+	swarm_hashes       [][]byte
+	swarm_tiers        []*tracker.Tiers
 	metadata           map[string]interface{}
 	pieces_length 	   int64
 	total_length  	   int64
 	
 	files         	   []*file.File
 	pieces        	   []*piece.Piece
+	// the data of verified pieces that belongs to files we don't download
+	part_file          *file.PartFile
+	// the directory the torrent is saved in once complete. until then
+	// it's in the incomplete directory, if there is one
+	save_path          string
+	// the directory the files are in now. it only changes once a move
+	// has succeeded
+	data_dir           string
+	// requests to move the torrent, from outside of Run
+	move_requests      chan *moveRequest
+	// file priorities changed from outside of Run
+	priority_requests  chan priorityRequest
+	// every peer we've been told about, and the ones we're connected to
+	pool               *connection.Pool
+	// the version of the blocklist the peers were last checked against
+	filter_version     int64
+	completed          bool
+	// the files couldn't be written, so nothing more is downloaded
+	failed             bool
+	stats              *stats.Stats
+	// this torrents own limits, on top of the global ones
+	download_limit     *ratelimit.Bucket
+	upload_limit       *ratelimit.Bucket
+	// peers that connected to us, from the listener
+	incoming           chan *peer.Peer
+	// chan for trackers and local service discovery to hand over the
+	// peers they find
+	found_peers        chan *peer.Peer
+	// closed by Close to have Run shut the torrent down, and by Run once
+	// it has. running is set once Run starts, so Close knows to wait
+	stop               chan bool
+	stopped            chan bool
+	running            bool
+	lock               sync.Mutex
 
 	ui 				   *ui.UI
 }
 
-func NewTorrent(magnet_uri string) *Torrent {
-	t := Torrent{}
-
-	u, err := url.Parse(magnet_uri)
-	if err != nil {
-		panic(err)
-	}
+// the result chan is nil for the move out of the incomplete directory
+type moveRequest struct {
+	save_path string
+	result    chan error
+	from      string
+	to        string
+	err       error
+}
 
-	query, err := url.ParseQuery(u.RawQuery)
-	if err != nil {
-		panic(err)
-	}
+type priorityRequest struct {
+	file     *file.File
+	priority file.Priority
+}
 
-	t.Name = query["dn"][0]
+func NewTorrent(magnet_uri string) (*Torrent, error) {
+	t := Torrent{}
 
-	xt := strings.Split(query["xt"][0], ":")
-	hash, err := hex.DecodeString(xt[len(xt)-1])
+	m, err := ParseMagnet(magnet_uri)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	t.Hash = hash
 
-	tr := query["tr"]
-
-	for _, element := range tr {
-		t.Trackers = append(t.Trackers, tracker.NewTracker(element))
+	t.magnet = m
+	t.Name = m.DisplayName()
+	t.swarm_hashes = m.SwarmHashes()
+	t.Hash = t.swarm_hashes[0]
+	t.stats = stats.NewStats()
+	t.download_limit = ratelimit.NewBucket(ratelimit.KiB(config.TorrentDownloadLimit))
+	t.upload_limit = ratelimit.NewBucket(ratelimit.KiB(config.TorrentUploadLimit))
+
+	t.tiers = t.newTiers()
+	t.Trackers = t.tiers.GetTrackers()
+	for range t.swarm_hashes[1:] {
+		t.swarm_tiers = append(t.swarm_tiers, t.newTiers())
 	}
 
 	t.metadata = nil
 	t.total_length = 0
-
-	return &t
+	t.pool = connection.NewPool(connection.DefaultManager)
+	t.filter_version = ipfilter.Default.GetVersion()
+	t.incoming = make(chan *peer.Peer, 50)
+	t.found_peers = make(chan *peer.Peer, 500)
+	t.save_path = config.DownloadDir
+	t.data_dir = t.dataDirFor(t.save_path)
+	t.move_requests = make(chan *moveRequest)
+	t.priority_requests = make(chan priorityRequest, 100)
+	t.stop = make(chan bool)
+	t.stopped = make(chan bool)
+
+	return &t, nil
 }
 
-func (t *Torrent) ConnectTrackers() {
-	connect_status := make(chan bool)
-
-	for _, track := range t.Trackers {
-		go track.Connect(connect_status)
+// magnet links have no tiers, so like other clients we give each
+// tracker its own tier, keeping the order they were listed in. trackers
+// with bad urls are skipped, and dropped from the link so they're only
+// reported once
+func (t *Torrent) newTiers() *tracker.Tiers {
+	tiers := make([][]*tracker.Tracker, 0)
+	urls := make([]string, 0)
+	for _, element := range t.magnet.Trackers {
+		track, err := tracker.NewTracker(element)
+		if err != nil {
+			log.Printf("skipping tracker: %v", err)
+			continue
+		}
+		track.SetStats(t.stats)
+		tiers = append(tiers, []*tracker.Tracker{track})
+		urls = append(urls, element)
 	}
+	t.magnet.Trackers = urls
 
-	for i := 0; i < len(t.Trackers); i++ {
-		<-connect_status
-	}
+	return tracker.NewTiers(tiers)
+}
 
-	t.connected_trackers = 0
-	for _, track := range t.Trackers {
-		if track.IsConnected() {
-			t.connected_trackers += 1
-		}
-	}
+// start announcing to the trackers for another swarm of this torrent.
+// trackers keep their state per swarm, so the swarm gets trackers of its
+// own
+func (t *Torrent) joinSwarm(hash []byte) {
+	tiers := t.newTiers()
+	tiers.Run(hash, t.found_peers)
+
+	t.swarm_hashes = append(t.swarm_hashes, hash)
+	t.swarm_tiers = append(t.swarm_tiers, tiers)
 }
 
-func (t *Torrent) AnnounceTrackers() {
-	announce_status := make(chan bool)
+// the tiers of every swarm we're in
+func (t *Torrent) allTiers() []*tracker.Tiers {
+	return append([]*tracker.Tiers{t.tiers}, t.swarm_tiers...)
+}
 
-	for _, track := range t.Trackers {
-		if track.IsConnected() {
-			go track.Announce(t.Hash, announce_status)
+// get the info hash and tracker urls to scrape from either a magnet uri
+// or a hex encoded info hash
+func ParseScrapeTarget(target string) ([]byte, []string, error) {
+	if strings.HasPrefix(target, "magnet:") == false {
+		hash, err := ParseInfoHash(target)
+		if err != nil {
+			return nil, nil, err
 		}
+		return hash, nil, nil
 	}
-	for i := 0; i < t.connected_trackers; i++ {
-		<-announce_status
+
+	m, err := ParseMagnet(target)
+	if err != nil {
+		return nil, nil, err
 	}
+
+	return m.SwarmHashes()[0], m.Trackers, nil
 }
 
 func (t *Torrent) Run() {
+	t.lock.Lock()
+	select {
+		case <-t.stop:
+			// closed before it ever ran
+			t.lock.Unlock()
+			return
+		default:
+	}
+	t.running = true
+	t.lock.Unlock()
+	defer close(t.stopped)
+
 	// chan for delivering metadata to the torrent object
 	metadata := make(chan []byte, 500)
 	// chan for requesting the next available chunk of the torrent for a given peer to request
 	request_chunk := make(chan *peer.Peer)
-
-	for _, track := range t.Trackers {
-		if track.IsConnected() {
-			go track.Run(t.Hash, metadata, request_chunk)
-		}
+	for i, tiers := range t.allTiers() {
+		tiers.Run(t.swarm_hashes[i], t.found_peers)
+	}
+	go t.addMagnetPeers()
+
+	peer_check := time.NewTicker(10 * time.Second)
+	defer peer_check.Stop()
+	// dial queued peers as connections finish or drop
+	connection_check := time.NewTicker(time.Second)
+	defer connection_check.Stop()
+	// with no interval files are only flushed as they're closed
+	var flush_check <-chan time.Time
+	if config.FlushInterval > 0 {
+		flush_ticker := time.NewTicker(time.Duration(config.FlushInterval) * time.Second)
+		defer flush_ticker.Stop()
+		flush_check = flush_ticker.C
 	}
+	// files are moved off this goroutine so peers are still served
+	// meanwhile. until the move is done nothing is written to them:
+	// pieces stay in memory unverified, and priority changes and other
+	// moves wait
+	moved := make(chan *moveRequest, 1)
+	moving := false
 
 	for {
+		move_requests := t.move_requests
+		priority_requests := t.priority_requests
+		if moving {
+			move_requests = nil
+			priority_requests = nil
+		}
+
 		select {
+			// the peers and files are only touched here, so the torrent
+			// is shut down here too
+			case <-t.stop:
+				if moving {
+					t.finishMove(<-moved)
+				}
+				t.shutdown()
+				return
+
+			// a tracker or the local network found a peer, queue it
+			case p := <-t.found_peers:
+				t.pool.Add(p)
+				t.connectPeers(metadata, request_chunk)
+
+			// a peer connected to us, start it unless we're at a limit
+			// or already talking to it
+			case p := <-t.incoming:
+				if t.pool.Accept(p) {
+					t.startPeer(p, metadata, request_chunk)
+				} else {
+					p.Close()
+				}
+
+			case <-connection_check.C:
+				// the blocklist was reloaded, drop the peers it blocks now
+				if version := ipfilter.Default.GetVersion(); version != t.filter_version {
+					t.filter_version = version
+					t.pool.RemoveBlocked()
+				}
+				t.connectPeers(metadata, request_chunk)
+
+			case req := <-move_requests:
+				moving = t.startMove(req, moved)
+
+			case req := <-moved:
+				moving = false
+				t.finishMove(req)
+
+			// writes are only flushed now and then, rather than each one
+			case <-flush_check:
+				if moving == false {
+					for _, f := range t.files {
+						if err := f.Flush(); err != nil {
+							t.fail(err)
+						}
+					}
+				}
+
+			case req := <-priority_requests:
+				t.setPriority(req.file, req.priority)
+				t.updatePieces()
+
+			// ask the trackers for more peers if we're running low
+			case <-peer_check.C:
+				connected := 0
+				for _, p := range t.pool.GetPeers() {
+					if p.IsConnected() {
+						connected++
+						// peers reachable over both ipv4 and ipv6 only
+						// get connected to on the other address once
+						if alt := p.GetAltPeer(); alt != nil && t.pool.IsKnown(alt.GetAddr()) == false {
+							t.pool.Add(alt)
+						}
+					}
+				}
+				if connected < config.MinPeers {
+					for _, tiers := range t.allTiers() {
+						tiers.RequestPeers()
+					}
+				}
+
 			// torrent got metadata from a peer
 			case data := <-metadata:
 				if t.metadata == nil {
@@ -117,35 +325,179 @@ func (t *Torrent) Run() {
 
 			// a peer alerts the torrent it is ready to request a chunk
 			case p := <-request_chunk:
+				if t.failed {
+					p.ClaimChunk(nil)
+					break
+				}
+
 				// allow the peer to lay claim to an available chunk
 				p.ClaimChunk(t.pieces)
 
 				// update ui percent bar
-				if len(t.pieces) > 0 {
-					completed_chunks := 0
+				if len(t.pieces) > 0 && moving == false {
+					// progress is counted in bytes of the files we want, so
+					// padding and unwanted files sharing a piece don't count
+					completed_bytes := int64(0)
+					total_bytes := int64(0)
 					total_chunks := 0
+					completed_pieces := true
+					left := int64(0)
 					for _, p := range t.pieces {
 						if p.IsDownloadable() {
-							completed, total, _ := p.ChunksCount()
+							completed, total, success, corrupt, err := p.ChunksCount()
+							if err != nil {
+								t.fail(err)
+							}
 							total_chunks += total
-							completed_chunks += completed
+							wanted := p.GetBytesWanted()
+							total_bytes += wanted
+							if success {
+								completed_bytes += wanted
+							} else if completed < total {
+								completed_bytes += wanted * int64(completed) / int64(total)
+							}
+							if success == false {
+								completed_pieces = false
+							}
+							// a full piece that failed verification has had
+							// its chunks reset for download
+							if corrupt {
+								t.stats.AddCorrupt(p.GetLength())
+							}
 						}
-						
+						left += p.GetBytesLeft()
 					}
 
-					t.ui.SetPercent(completed_chunks, total_chunks)
+					t.stats.SetLeft(left)
+
+					t.ui.SetPercent(int(completed_bytes), int(total_bytes))
+
+					if completed_pieces && total_chunks > 0 && t.completed == false {
+						t.completed = true
+						for _, tiers := range t.allTiers() {
+							tiers.Completed()
+						}
+						for _, f := range t.files {
+							if err := f.Flush(); err != nil {
+								t.fail(err)
+							}
+						}
+						// out of the incomplete directory
+						moving = t.startMove(&moveRequest{save_path: t.save_path}, moved)
+					}
 				}
 
 		}
 	}
 }
 
+// queue the peers listed in the magnet link. names are looked up here
+// rather than while parsing, and not at all in proxy only mode where the
+// lookup would go around the proxy
+func (t *Torrent) addMagnetPeers() {
+	for _, address := range t.magnet.Peers {
+		host, port_str, err := net.SplitHostPort(address)
+		if err != nil {
+			// i2p destinations don't need a port
+			host, port_str = address, "0"
+		}
+		port, err := strconv.ParseUint(port_str, 10, 16)
+		if err != nil {
+			continue
+		}
+
+		var p *peer.Peer
+		if strings.HasSuffix(host, ".i2p") {
+			p = peer.NewPeerAt(peer.Address{Destination: host})
+		} else {
+			ip := net.ParseIP(host)
+			if ip == nil && proxy.Only() == false {
+				if ips, err := net.LookupIP(host); err == nil && len(ips) > 0 {
+					ip = ips[0]
+				}
+			}
+			if ip == nil || port == 0 || ipfilter.Default.IsBlocked(ip) {
+				continue
+			}
+			p = peer.NewPeer(ip, uint16(port))
+		}
+
+		p.SetSource(peer.SourceMagnet)
+		t.found_peers <- p
+	}
+}
+
+// start the peers the pool picks to dial
+func (t *Torrent) connectPeers(metadata chan []byte, request_chunk chan *peer.Peer) {
+	for _, p := range t.pool.Update() {
+		t.startPeer(p, metadata, request_chunk)
+	}
+}
+
+func (t *Torrent) startPeer(p *peer.Peer, metadata chan []byte, request_chunk chan *peer.Peer) {
+	p.SetStats(t.stats)
+	p.SetLimits(
+		[]*ratelimit.Bucket{ratelimit.GlobalDownload, t.download_limit},
+		[]*ratelimit.Bucket{ratelimit.GlobalUpload, t.upload_limit},
+	)
+	// peers are handshaked with the hash of the swarm they're in
+	hash := p.GetInfoHash()
+	if hash == nil {
+		hash = t.Hash
+	}
+	go p.Run(hash, metadata, request_chunk)
+}
+
 func (t *Torrent) ParseMetadata(data []byte) {
+	// metadata has to hash to one of the info hashes we know
+	v1 := sha1.Sum(data)
+	v2 := sha256.Sum256(data)
+	v1_ok := t.magnet.Hash != nil && bytes.Equal(v1[:], t.magnet.Hash)
+	v2_ok := t.magnet.HashV2 != nil && bytes.Equal(v2[:], t.magnet.HashV2)
+	if v1_ok == false && v2_ok == false {
+		return
+	}
+
 	if err := bencode.DecodeBytes(data, &t.metadata); err != nil {
 		t.metadata = nil
 		return
 	}
 	t.pieces_length = t.metadata["piece length"].(int64)
+
+	// a hybrid torrent is both v1 and v2, so we can join the swarm of the
+	// hash our magnet link didn't have
+	version, _ := t.metadata["meta version"].(int64)
+	_, has_pieces := t.metadata["pieces"]
+	if version == 2 && has_pieces {
+		if t.magnet.Hash == nil {
+			t.magnet.Hash = v1[:]
+			t.joinSwarm(t.magnet.Hash)
+		} else if t.magnet.HashV2 == nil {
+			t.magnet.HashV2 = v2[:]
+			t.joinSwarm(t.magnet.HashV2[:20])
+		}
+	}
+
+	// without a dn param we've been showing the info hash, use the real
+	// name now that we have it
+	if name, ok := t.metadata["name"].(string); ok && t.magnet.Name == "" {
+		t.Name = name
+		t.ui.SetName(name)
+	}
+
+	// without v1 piece hashes the torrent is v2 only, its files are in a
+	// tree and its pieces are checked against each files merkle tree
+	if tree, ok := t.metadata["file tree"].(map[string]interface{}); ok && has_pieces == false {
+		if err := t.addFileTree(tree, []string{}); err != nil {
+			t.refuse(err)
+			return
+		}
+		file.MakeUnique(t.files)
+		t.initPiecesV2()
+		t.SelectFile()
+		return
+	}
+
 	if _, ok := t.metadata["files"]; ok {
 		for _, f := range t.metadata["files"].([]interface{}) {
 			m := f.(map[string]interface{})
@@ -154,72 +506,412 @@ func (t *Torrent) ParseMetadata(data []byte) {
 			p := m["path"].([]interface{})
 
 			path := make([]string, 0)
-			path = append(path, "downloads")
-			path = append(path, t.Name)
 			for _, path_seq := range p {
 				var str string = fmt.Sprintf("%v", path_seq)
 				path = append(path, str)
 			}
 
-			t.addFile(file.NewFile(length, path))
+			f, err := t.newFile(length, path, m)
+			if err != nil {
+				t.refuse(err)
+				return
+			}
+			t.addFile(f)
 		}
 	} else {
 		// single file torrent
 		length := t.metadata["length"].(int64)
 		name := t.metadata["name"].(string)
 
-		path := make([]string, 0)
-		path = append(path, "downloads")
-		path = append(path, t.Name)
-		path = append(path, name)
-
-		t.addFile(file.NewFile(length, path))
+		f, err := t.newFile(length, []string{name}, t.metadata)
+		if err != nil {
+			t.refuse(err)
+			return
+		}
+		t.addFile(f)
 
 	}
 
+	file.MakeUnique(t.files)
+
 	t.initPieces([]byte(t.metadata["pieces"].(string)))
 
 	t.SelectFile()
 }
 
-func (t *Torrent) SelectFile() {
-	file_chan := make(chan int)
-	t.ui.SelectFile(t.files, file_chan)
+// don't download a torrent whose metadata we can't use. the metadata is
+// kept so it isn't fetched and parsed again
+func (t *Torrent) refuse(err error) {
+	t.files = nil
+	t.total_length = 0
+	t.ui.SetError("can't download this torrent: " + err.Error())
+}
 
-	file_index := <- file_chan
-	
-	if file_index < len(t.files) {
-		f := t.files[file_index]
-		f.SetDownloadable(true)
+// stop downloading a torrent whose files can't be written, such as when
+// the disk is full
+func (t *Torrent) fail(err error) {
+	if t.failed == false {
+		t.failed = true
+		t.ui.SetError("couldn't write the download: " + err.Error())
+	}
+}
 
-		start_piece, end_piece := f.GetStartAndEndPieces()
-		for i := start_piece; i <= end_piece; i++ {
-			t.pieces[i].SetDownloadable(true)
+// add the files of a v2 file tree in order. a file is a dict whose empty
+// key holds its length and pieces root, any other dict is a directory
+// see: http://bittorrent.org/beps/bep_0052.html#info-dictionary
+func (t *Torrent) addFileTree(tree map[string]interface{}, path []string) error {
+	// dicts are sorted by key, which the map has lost
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		node, ok := tree[name].(map[string]interface{})
+		if ok == false {
+			continue
 		}
-	} else {
-		for _, f := range t.files { 
-			f.SetDownloadable(true)
+		node_path := append(append([]string{}, path...), name)
+
+		if leaf, ok := node[""].(map[string]interface{}); ok {
+			length, _ := leaf["length"].(int64)
+			f, err := t.newFile(length, node_path, leaf)
+			if err != nil {
+				return err
+			}
+			if root, ok := leaf["pieces root"].(string); ok {
+				f.SetPiecesRoot([]byte(root), t.pieces_length)
+			}
+			t.addFile(f)
+		} else if err := t.addFileTree(node, node_path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// a file with the attributes from its entry in the metadata, at its
+// sanitised path under the torrents directory
+func (t *Torrent) newFile(length int64, elements []string, entry map[string]interface{}) (*file.File, error) {
+	path, err := file.SanitisePath(elements)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %q", err, strings.Join(elements, "/"))
+	}
+	f := file.NewFile(length, path)
+	f.SetLocation(t.data_dir, t.rootFolder())
+
+	attr, _ := entry["attr"].(string)
+	symlink_path := make([]string, 0)
+	if elements, ok := entry["symlink path"].([]interface{}); ok {
+		for _, element := range elements {
+			symlink_path = append(symlink_path, fmt.Sprintf("%v", element))
+		}
+	}
+	// the target has to name its file as it's saved. . and .. are left
+	// alone for Link to refuse, rather than dropped to point elsewhere
+	for i, element := range symlink_path {
+		if element != "." && element != ".." {
+			symlink_path[i] = file.SanitiseName(element)
+		}
+	}
+	f.SetAttributes(attr, symlink_path)
+
+	return f, nil
+}
+
+// the folder the torrents files go in, empty if they go straight in the
+// save path. its name comes from the magnet link or the metadata, so it's
+// sanitised like the rest of the path
+func (t *Torrent) rootFolder() string {
+	if config.CreateRootFolder == false {
+		return ""
+	}
+
+	name := file.SanitiseName(t.Name)
+	if name == "" {
+		name = hex.EncodeToString(t.Hash)
+	}
+
+	return name
+}
+
+// the directory the torrents files belong in with the given save path
+func (t *Torrent) dataDirFor(save_path string) string {
+	if config.IncompleteDir != "" && t.completed == false {
+		return config.IncompleteDir
+	}
+
+	return save_path
+}
+
+// save the torrent somewhere other than the default directory. only for
+// before it runs, use Move after that
+func (t *Torrent) SetSavePath(save_path string) {
+	t.save_path = save_path
+	t.data_dir = t.dataDirFor(save_path)
+}
+
+// move the torrent to a new save path while it runs. an incomplete
+// torrent in the incomplete directory stays there until it completes
+func (t *Torrent) Move(save_path string) error {
+	req := &moveRequest{save_path: save_path, result: make(chan error, 1)}
+	select {
+		case t.move_requests <- req:
+		case <-t.stop:
+			return errors.New("torrent is closed")
+	}
+
+	return <-req.result
+}
+
+// start moving the files to where they belong with the requests save
+// path, returning whether a move is under way. without files there's
+// nothing to move, so it's done straight away
+func (t *Torrent) startMove(req *moveRequest, moved chan *moveRequest) bool {
+	req.from = t.data_dir
+	req.to = t.dataDirFor(req.save_path)
+	if req.from == req.to || len(t.files) == 0 {
+		t.finishMove(req)
+		return false
+	}
+
+	go func() {
+		req.err = t.moveData(req.from, req.to)
+		moved <- req
+	}()
+
+	return true
+}
+
+// the save path only changes once the files are there
+func (t *Torrent) finishMove(req *moveRequest) {
+	if req.err == nil {
+		t.save_path = req.save_path
+		t.data_dir = req.to
+	}
+
+	if req.result != nil {
+		req.result <- req.err
+	} else if req.err != nil {
+		t.ui.SetError("couldn't move the download: " + req.err.Error())
+	}
+}
+
+// move the files from one directory to another, then remove the folders
+// they leave empty. if any can't be moved the ones that were are moved
+// back, so the files are never split between the two
+func (t *Torrent) moveData(from string, to string) error {
+	for i, f := range t.files {
+		if err := f.Move(to); err != nil {
+			t.moveBack(t.files[:i], from, to)
+			return err
+		}
+	}
+	if t.part_file != nil {
+		if err := t.part_file.Move(to); err != nil {
+			t.moveBack(t.files, from, to)
+			return err
+		}
+	}
+
+	t.removeFolders(from)
+
+	return nil
+}
+
+func (t *Torrent) moveBack(files []*file.File, from string, to string) {
+	for _, f := range files {
+		f.Move(from)
+	}
+	t.removeFolders(to)
+}
+
+// remove the torrents folders from dir, if they're empty
+func (t *Torrent) removeFolders(dir string) {
+	// deepest first, so a folder's subfolders are gone before it is
+	folders := make([]string, 0)
+	for _, f := range t.files {
+		path := f.GetDisplayPath()
+		for i := 1; i < len(path); i++ {
+			folders = append(folders, filepath.Join(path[:i]...))
+		}
+	}
+	sort.Slice(folders, func(i, j int) bool {
+		return len(folders[i]) > len(folders[j])
+	})
+	root := filepath.Join(dir, t.rootFolder())
+	for _, folder := range folders {
+		os.Remove(filepath.Join(root, folder))
+	}
+	if t.rootFolder() != "" {
+		os.Remove(root)
+	}
+}
+
+func (t *Torrent) SelectFile() {
+	// padding files aren't shown. the so param still counts them, as
+	// it indexes the files in the metadata
+	files := make([]*file.File, 0)
+	for _, f := range t.files {
+		if f.IsPadding() == false {
+			files = append(files, f)
+		}
+	}
+
+	// a link that selects its files doesn't need to ask
+	if t.magnet.Select != nil {
+		first := -1
+		for i, f := range t.files {
+			if t.magnet.Selects(i) == false || f.IsPadding() {
+				continue
+			}
+			t.setPriority(f, file.PriorityNormal)
+		}
+		t.updatePieces()
+		for i, f := range files {
+			if f.IsDownloadable() && first < 0 {
+				first = i
+			}
+		}
+
+		// unless none of the indices match a file
+		if first >= 0 {
+			t.ui.ShowSelectedFiles(files, first)
+			return
 		}
-		for _, pi := range t.pieces { 
-			pi.SetDownloadable(true)
+	}
+
+	file_chan := make(chan []file.Priority)
+	t.ui.SelectFile(files, file_chan)
+
+	var priorities []file.Priority
+	select {
+		case priorities = <-file_chan:
+		// Run picks the close up once we return
+		case <-t.stop:
+			return
+	}
+
+	for i, f := range files {
+		t.setPriority(f, priorities[i])
+	}
+	t.updatePieces()
+}
+
+// change a files priority while the torrent runs
+func (t *Torrent) SetFilePriority(f *file.File, priority file.Priority) {
+	select {
+		case t.priority_requests <- priorityRequest{f, priority}:
+		case <-t.stop:
+	}
+}
+
+// set a files priority. call updatePieces once all the files are set.
+// symlinks have no data, so they're made as soon as they're wanted
+func (t *Torrent) setPriority(f *file.File, priority file.Priority) {
+	f.SetPriority(priority)
+	if f.IsDownloadable() == false {
+		return
+	}
+
+	if err := f.Link(); err != nil {
+		t.ui.SetMessage("couldn't create " + strings.Join(f.GetDisplayPath(), "/") + ": " + err.Error())
+	}
+
+	// there's more to download, so we'll complete again
+	start_piece, end_piece := f.GetStartAndEndPieces()
+	for i := start_piece; i <= end_piece; i++ {
+		if t.pieces[i].IsValid() == false {
+			t.completed = false
 		}
 	}
 }
 
+// work out which pieces we want, and how much, from the priorities of
+// the files they have data for
+func (t *Torrent) updatePieces() {
+	for _, p := range t.pieces {
+		p.UpdatePriority()
+	}
+}
+
 func (t *Torrent) SetUI(u *ui.UI) {
 	t.ui = u
+	t.ui.SetStats(t.stats)
+	t.ui.SetMove(t.Move)
+	t.ui.SetPrioritise(t.SetFilePriority)
+	t.ui.SetLimiter(t.GetLimits, t.SetLimits)
+}
+
+// the chan the listener hands incoming peers for this torrent to
+func (t *Torrent) IncomingPeers() chan *peer.Peer {
+	return t.incoming
+}
+
+// the chan peer sources other than the trackers hand new peers to
+func (t *Torrent) FoundPeers() chan *peer.Peer {
+	return t.found_peers
+}
+
+func (t *Torrent) GetStats() *stats.Stats {
+	return t.stats
+}
+
+// change this torrents limits in KiB/s, 0 for unlimited
+func (t *Torrent) SetLimits(download int, upload int) {
+	t.download_limit.SetRate(ratelimit.KiB(download))
+	t.upload_limit.SetRate(ratelimit.KiB(upload))
+}
+
+// this torrents own limits in KiB/s, 0 for unlimited
+func (t *Torrent) GetLimits() (int, int) {
+	return int(t.download_limit.GetRate() / 1024), int(t.upload_limit.GetRate() / 1024)
 }
 
+// stop the torrent, waiting for Run to shut it down if it's running.
+// safe to call more than once
 func (t *Torrent) Close() {
-	for _, track := range t.Trackers {
-		if track.IsConnected() {
-			track.Close()
+	t.lock.Lock()
+	select {
+		case <-t.stop:
+			t.lock.Unlock()
+			<-t.stopped
+			return
+		default:
+	}
+	close(t.stop)
+	running := t.running
+	t.lock.Unlock()
+
+	if running {
+		<-t.stopped
+	} else {
+		t.shutdown()
+		close(t.stopped)
+	}
+}
+
+func (t *Torrent) shutdown() {
+	for i, tiers := range t.allTiers() {
+		tiers.Close(t.swarm_hashes[i])
+	}
+
+	for _, p := range t.pool.GetPeers() {
+		if p.IsConnected() {
+			p.Close()
 		}
 	}
 
 	for _, f := range t.files {
 		f.Close()
 	}
+
+	// nothing's resumed, so the data kept in it is of no more use
+	if t.part_file != nil {
+		t.part_file.Remove()
+	}
 }
 
 func (t *Torrent) addFile(f *file.File) {
@@ -227,7 +919,17 @@ func (t *Torrent) addFile(f *file.File) {
 	t.total_length += f.GetLength()
 }
 
+// the hashes of the swarms we're in, for the listener and local service
+// discovery to accept peers from
+func (t *Torrent) SwarmHashes() [][]byte {
+	return t.swarm_hashes
+}
+
 func (t *Torrent) addPiece(p *piece.Piece) {
+	if t.part_file == nil {
+		t.part_file = file.NewPartFile(t.data_dir, "." + hex.EncodeToString(t.Hash) + ".parts", t.pieces_length)
+	}
+	p.SetPartFile(t.part_file)
 	p.InitChunks()
 	t.pieces = append(t.pieces, p)
 }
@@ -265,3 +967,35 @@ func (t *Torrent) initPieces(pieces []byte) {
 	t.addPiece(current_piece)
 	current_piece = nil
 }
+
+// v2 files each start a new piece. a file of a piece or less is checked
+// against its pieces root directly, longer ones against their piece layer
+func (t *Torrent) initPiecesV2() {
+	index := int64(0)
+	blocks_per_piece := int(t.pieces_length / merkle.BlockSize)
+
+	for _, f := range t.files {
+		f.SetStartPiece(index)
+
+		file_bytes_remaining := f.GetLength()
+		single := file_bytes_remaining <= t.pieces_length
+		for file_bytes_remaining > 0 {
+			current_piece := piece.NewPiece(index, t.pieces_length)
+			file_bytes_remaining = current_piece.AddBoundary(f, file_bytes_remaining)
+
+			if single {
+				blocks := int((f.GetLength() + merkle.BlockSize - 1) / merkle.BlockSize)
+				current_piece.SetHash(f.GetPiecesRoot())
+				current_piece.SetMerkle(f, merkle.NextPow2(blocks))
+			} else {
+				current_piece.SetMerkle(f, blocks_per_piece)
+			}
+
+			t.addPiece(current_piece)
+			index++
+		}
+
+		// empty files have no pieces
+		f.SetEndPiece(index - 1)
+	}
+}
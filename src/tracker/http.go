@@ -0,0 +1,176 @@
+package tracker
+
+import (
+	"../config"
+	"../i2p"
+	"../ipfilter"
+	"../peer"
+	"../proxy"
+	"errors"
+	"github.com/zeebo/bencode"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// names of the announce events for http trackers
+var http_events = map[uint32]string{
+	EventCompleted: "completed",
+	EventStarted:   "started",
+	EventStopped:   "stopped",
+}
+
+// announce to an http tracker
+// see: https://wiki.theory.org/BitTorrentSpecification#Tracker_HTTP.2FHTTPS_Protocol
+func (t *Tracker) announceHttp(hash []byte, event uint32) error {
+	return t.announceHttpWithin(hash, event, t.timeout(0))
+}
+
+// announce to an http tracker, giving up after timeout
+func (t *Tracker) announceHttpWithin(hash []byte, event uint32, timeout time.Duration) error {
+	u := *t.announce_url
+
+	query := u.Query()
+	query.Set("info_hash", string(hash))
+	query.Set("peer_id", "UVG01234567891234567")
+	query.Set("port", strconv.Itoa(config.ListenPort))
+	query.Set("uploaded", strconv.FormatInt(t.stats.GetUploaded(), 10))
+	query.Set("downloaded", strconv.FormatInt(t.stats.GetDownloaded(), 10))
+	query.Set("left", strconv.FormatInt(t.stats.GetLeft(), 10))
+	query.Set("compact", "1")
+	if name, ok := http_events[event]; ok {
+		query.Set("event", name)
+	}
+	if t.tracker_id != "" {
+		query.Set("trackerid", t.tracker_id)
+	}
+	// i2p trackers know us by our destination rather than an ip
+	if t.IsI2P() {
+		if session := i2p.Default(); session != nil {
+			query.Set("ip", session.Destination()+".i2p")
+		}
+	}
+	// tell the tracker our ipv6 address so ipv6 peers can find us, even
+	// when the announce itself goes out over ipv4
+	// see: http://bittorrent.org/beps/bep_0007.html
+	if config.EnableIPv6 && proxy.Enabled() == false && t.IsI2P() == false {
+		if ip := peer.LocalIPv6(); ip != nil {
+			query.Set("ipv6", ip.String())
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	client, err := t.httpClient(timeout)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Cancel = t.cancel
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return t.ParseHttpAnnounceResponse(body)
+}
+
+// a client that reaches the tracker, through i2p for .i2p trackers and
+// through the proxy for the rest
+func (t *Tracker) httpClient(timeout time.Duration) (*http.Client, error) {
+	if t.IsI2P() {
+		session := i2p.Default()
+		if session == nil {
+			return nil, errors.New("i2p is disabled")
+		}
+		return session.HttpClient(timeout), nil
+	}
+
+	return proxy.HttpClient(timeout), nil
+}
+
+func (t *Tracker) ParseHttpAnnounceResponse(body []byte) error {
+	var response map[string]interface{}
+	if err := bencode.DecodeBytes(body, &response); err != nil {
+		return err
+	}
+
+	if reason, ok := response["failure reason"].(string); ok {
+		return errors.New(reason)
+	}
+
+	if interval, ok := response["interval"].(int64); ok && interval > 0 {
+		t.interval = uint32(interval)
+	}
+	if min_interval, ok := response["min interval"].(int64); ok && min_interval > 0 {
+		t.min_interval = uint32(min_interval)
+	}
+	if t.min_interval > t.interval {
+		t.min_interval = t.interval
+	}
+	if complete, ok := response["complete"].(int64); ok {
+		t.seeders = uint32(complete)
+	}
+	if incomplete, ok := response["incomplete"].(int64); ok {
+		t.leechers = uint32(incomplete)
+	}
+	if tracker_id, ok := response["tracker id"].(string); ok {
+		t.tracker_id = tracker_id
+	}
+
+	switch peers := response["peers"].(type) {
+	case string:
+		if t.IsI2P() {
+			t.peers = append(t.peers, parseI2PPeers([]byte(peers))...)
+		} else {
+			t.peers = append(t.peers, parseCompactPeers([]byte(peers), net.IPv4len)...)
+		}
+	case []interface{}:
+		// the original non compact format, a list of dictionaries
+		for _, entry := range peers {
+			m, ok := entry.(map[string]interface{})
+			if ok == false {
+				continue
+			}
+			ip_str, _ := m["ip"].(string)
+			// i2p peers are given as their destination followed by .i2p
+			if strings.HasSuffix(ip_str, ".i2p") {
+				if strings.HasSuffix(ip_str, ".b32.i2p") == false {
+					ip_str = strings.TrimSuffix(ip_str, ".i2p")
+				}
+				t.peers = append(t.peers, peer.NewPeerAt(peer.Address{Destination: ip_str}))
+				continue
+			}
+			port, _ := m["port"].(int64)
+			ip := net.ParseIP(ip_str)
+			if ip == nil || port <= 0 || port > 65535 || ipfilter.Default.IsBlocked(ip) {
+				continue
+			}
+			t.peers = append(t.peers, peer.NewPeer(ip, uint16(port)))
+		}
+	}
+
+	// see: http://bittorrent.org/beps/bep_0007.html
+	if peers6, ok := response["peers6"].(string); ok {
+		t.peers = append(t.peers, parseCompactPeers([]byte(peers6), net.IPv6len)...)
+	}
+
+	if _, ok := response["peers"]; ok == false {
+		if _, ok := response["peers6"]; ok == false {
+			return errors.New("announce response has no peers")
+		}
+	}
+
+	return nil
+}
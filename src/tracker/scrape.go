@@ -0,0 +1,166 @@
+package tracker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/zeebo/bencode"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ask the tracker for the number of seeders, leechers and completed
+// downloads of a torrent without joining the swarm
+func (t *Tracker) Scrape(hash []byte) error {
+	var err error
+	switch t.scheme {
+	case "http", "https":
+		err = t.scrapeHttp(hash)
+	default:
+		err = t.scrapeUdp(hash)
+	}
+
+	if err != nil {
+		t.last_error = err.Error()
+		return err
+	}
+
+	t.scraped = true
+	return nil
+}
+
+// see: http://bittorrent.org/beps/bep_0015.html
+func (t *Tracker) scrapeUdp(hash []byte) error {
+	if err := t.dial(); err != nil {
+		return err
+	}
+
+	response, err := t.transact(ActionScrape, func(transaction_id uint32) ([]byte, error) {
+		connection_id, err := t.connectionId()
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, connection_id)
+		binary.Write(&buf, binary.BigEndian, ActionScrape)
+		binary.Write(&buf, binary.BigEndian, transaction_id)
+		binary.Write(&buf, binary.LittleEndian, hash)
+
+		return buf.Bytes(), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return t.ParseScrapeResponse(response)
+}
+
+// parse a udp scrape response for a single info hash
+func (t *Tracker) ParseScrapeResponse(scrape_response []byte) error {
+	if len(scrape_response) < 20 {
+		return errors.New("short scrape response")
+	}
+
+	t.seeders = binary.BigEndian.Uint32(scrape_response[8:12])
+	t.completed = binary.BigEndian.Uint32(scrape_response[12:16])
+	t.leechers = binary.BigEndian.Uint32(scrape_response[16:20])
+
+	return nil
+}
+
+// the scrape url is found by replacing "announce" in the last path
+// segment of the announce url with "scrape". trackers whose announce
+// url doesn't follow that convention don't support scraping
+// see: https://wiki.theory.org/BitTorrentSpecification#Tracker_.27scrape.27_Convention
+func (t *Tracker) scrapeUrl() (*url.URL, error) {
+	dir, last := path.Split(t.announce_url.Path)
+	if strings.HasPrefix(last, "announce") == false {
+		return nil, errors.New("tracker does not support scrape")
+	}
+
+	u := *t.announce_url
+	u.Path = dir + "scrape" + strings.TrimPrefix(last, "announce")
+
+	return &u, nil
+}
+
+func (t *Tracker) scrapeHttp(hash []byte) error {
+	u, err := t.scrapeUrl()
+	if err != nil {
+		return err
+	}
+
+	query := u.Query()
+	query.Set("info_hash", string(hash))
+	u.RawQuery = query.Encode()
+
+	client, err := t.httpClient(t.timeout(0))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Cancel = t.cancel
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var response map[string]interface{}
+	if err := bencode.DecodeBytes(body, &response); err != nil {
+		return err
+	}
+
+	if reason, ok := response["failure reason"].(string); ok {
+		return errors.New(reason)
+	}
+
+	files, ok := response["files"].(map[string]interface{})
+	if ok == false {
+		return errors.New("scrape response has no files")
+	}
+
+	stats, ok := files[string(hash)].(map[string]interface{})
+	if ok == false {
+		return errors.New("torrent not found in scrape response")
+	}
+
+	if complete, ok := stats["complete"].(int64); ok {
+		t.seeders = uint32(complete)
+	}
+	if incomplete, ok := stats["incomplete"].(int64); ok {
+		t.leechers = uint32(incomplete)
+	}
+	if downloaded, ok := stats["downloaded"].(int64); ok {
+		t.completed = uint32(downloaded)
+	}
+
+	return nil
+}
+
+// scrape every tracker at once, returning when they've all finished
+func ScrapeAll(trackers []*Tracker, hash []byte) {
+	done := make(chan bool)
+	for _, track := range trackers {
+		go func(track *Tracker) {
+			track.Scrape(hash)
+			done <- true
+		}(track)
+	}
+
+	for i := 0; i < len(trackers); i++ {
+		<-done
+	}
+}
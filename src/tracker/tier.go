@@ -0,0 +1,288 @@
+package tracker
+
+import (
+	"../config"
+	"../peer"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// trackers grouped into tiers. trackers within a tier are tried in order
+// until one works, which is then moved to the front of its tier. a tier
+// is only used when every tracker in the tiers before it has failed,
+// unless we've been asked to announce to all tiers
+// see: http://bittorrent.org/beps/bep_0012.html
+type Tiers struct {
+	tiers      [][]*Tracker
+	// every tracker, in an order the announcers don't change
+	trackers   []*Tracker
+	announcers []*announcer
+	stop       chan bool
+	closed     bool
+	running    bool
+	lock       sync.Mutex
+}
+
+// a goroutine announcing to one or more tiers
+type announcer struct {
+	tiers        [][]*Tracker
+	// the tracker we last announced to successfully
+	current      *Tracker
+	// set when the torrent is running low on peers
+	peers_wanted bool
+	// a completed event waiting to be sent. it stays set until a tracker
+	// has been told, so it's never lost
+	completed    bool
+	// what the torrent has asked for since the announcer last looked,
+	// and a wake up for it
+	requested    map[uint32]bool
+	wake         chan bool
+	lock         sync.Mutex
+	// closed once run returns
+	done         chan bool
+}
+
+func NewTiers(tiers [][]*Tracker) *Tiers {
+	ts := Tiers{}
+	ts.stop = make(chan bool)
+
+	for _, tier := range tiers {
+		if len(tier) == 0 {
+			continue
+		}
+
+		// shuffle each tier so clients don't all hit the same tracker first
+		shuffled := make([]*Tracker, len(tier))
+		for i, j := range rand.Perm(len(tier)) {
+			shuffled[i] = tier[j]
+		}
+		ts.tiers = append(ts.tiers, shuffled)
+		ts.trackers = append(ts.trackers, shuffled...)
+	}
+
+	if config.AnnounceToAllTiers {
+		for i := range ts.tiers {
+			ts.announcers = append(ts.announcers, newAnnouncer(ts.tiers[i:i+1]))
+		}
+	} else if len(ts.tiers) > 0 {
+		ts.announcers = append(ts.announcers, newAnnouncer(ts.tiers))
+	}
+
+	return &ts
+}
+
+func newAnnouncer(tiers [][]*Tracker) *announcer {
+	a := announcer{}
+	a.tiers = tiers
+	a.requested = make(map[uint32]bool)
+	a.wake = make(chan bool, 1)
+	a.done = make(chan bool)
+
+	return &a
+}
+
+// every tracker, in tier order
+func (ts *Tiers) GetTrackers() []*Tracker {
+	trackers := make([]*Tracker, 0)
+	for _, tier := range ts.tiers {
+		trackers = append(trackers, tier...)
+	}
+
+	return trackers
+}
+
+// announce to the tiers until closed, handing any peers found to the torrent
+func (ts *Tiers) Run(hash []byte, peers chan *peer.Peer) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if ts.closed || ts.running {
+		return
+	}
+	ts.running = true
+
+	for _, a := range ts.announcers {
+		go a.run(hash, peers, ts.stop)
+	}
+}
+
+// ask the trackers for more peers as soon as min interval allows
+func (ts *Tiers) RequestPeers() {
+	for _, a := range ts.announcers {
+		a.queueEvent(EventNone)
+	}
+}
+
+// tell the trackers we finished downloading
+func (ts *Tiers) Completed() {
+	for _, a := range ts.announcers {
+		a.queueEvent(EventCompleted)
+	}
+}
+
+// stop announcing and send a stopped event to every tracker we announced to
+func (ts *Tiers) Close(hash []byte) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if ts.closed {
+		return
+	}
+	ts.closed = true
+	close(ts.stop)
+
+	// wait for the announcers to finish, cutting short any request
+	// they're waiting on, so they aren't using the trackers as we do
+	if ts.running {
+		for _, track := range ts.trackers {
+			track.cancelRequests()
+		}
+		for _, a := range ts.announcers {
+			<-a.done
+		}
+	}
+
+	// all at once, so shutting down waits on the slowest tracker rather
+	// than every one in turn
+	var wg sync.WaitGroup
+	for _, tier := range ts.tiers {
+		for _, track := range tier {
+			wg.Add(1)
+			go func(track *Tracker) {
+				defer wg.Done()
+				track.Close(hash)
+			}(track)
+		}
+	}
+	wg.Wait()
+}
+
+// ask for an event to be sent. asking again before it's been handled
+// changes nothing, and a completed event isn't pushed out by others
+func (a *announcer) queueEvent(event uint32) {
+	a.lock.Lock()
+	a.requested[event] = true
+	a.lock.Unlock()
+
+	select {
+	case a.wake <- true:
+	default:
+	}
+}
+
+// the events asked for since the last call
+func (a *announcer) takeRequested() map[uint32]bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	requested := a.requested
+	a.requested = make(map[uint32]bool)
+
+	return requested
+}
+
+func (a *announcer) run(hash []byte, peers chan *peer.Peer, stop chan bool) {
+	defer close(a.done)
+
+	a.announce(hash, EventStarted)
+
+	for {
+		if a.current != nil {
+			for _, p := range a.current.TakePeers() {
+				// hybrid torrents announce to a swarm per hash
+				p.SetInfoHash(hash)
+				select {
+				case peers <- p:
+				case <-stop:
+					return
+				}
+			}
+		}
+
+		wait := time.Duration(config.TrackerMinInterval) * time.Second
+		if a.current != nil {
+			wait = a.current.NextAnnounce(a.peers_wanted)
+		}
+
+		// a completed event that couldn't be sent is tried again with
+		// every announce
+		event := EventNone
+		if a.completed {
+			event = EventCompleted
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-a.wake:
+			requested := a.takeRequested()
+			if requested[EventNone] {
+				// more peers wanted, the wait is recalculated above
+				a.peers_wanted = true
+			}
+			if requested[EventCompleted] {
+				a.completed = true
+				if a.announce(hash, EventCompleted) {
+					a.completed = false
+				}
+			}
+		case <-time.After(wait):
+			if a.announce(hash, event) {
+				a.peers_wanted = false
+				if event == EventCompleted {
+					a.completed = false
+				}
+			}
+		}
+	}
+}
+
+// announce to the first tracker that works, going through each tier in
+// order. a tracker that works is moved to the front of its tier so it's
+// tried first next time. with more than one tracker, each gets a single
+// short try before any gets the full retry schedule, so a list of dead
+// trackers doesn't keep us waiting minutes for the first peers
+func (a *announcer) announce(hash []byte, event uint32) bool {
+	passes := []bool{false}
+	if len(a.tiers) > 1 || len(a.tiers[0]) > 1 {
+		passes = []bool{true, false}
+	}
+
+	for _, quick := range passes {
+		if a.announcePass(hash, event, quick) {
+			return true
+		}
+	}
+
+	a.current = nil
+	return false
+}
+
+func (a *announcer) announcePass(hash []byte, event uint32, quick bool) bool {
+	for _, tier := range a.tiers {
+		for i, track := range tier {
+			// a tracker that hasn't heard from us yet needs a started event
+			// before anything else
+			e := event
+			if track.announced == false && e == EventNone {
+				e = EventStarted
+			}
+
+			track.setQuick(quick)
+			ok := track.Announce(hash, e)
+			track.setQuick(false)
+
+			if ok {
+				copy(tier[1:i+1], tier[0:i])
+				tier[0] = track
+
+				if track != a.current && track.scraped == false {
+					track.Scrape(hash)
+				}
+				a.current = track
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -1,115 +1,415 @@
 package tracker
 
 import (
+	"../config"
+	"../i2p"
+	"../ipfilter"
 	"../peer"
+	"../proxy"
+	"../stats"
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
 	"net"
 	"net/url"
+	"strings"
 	"time"
 )
 
+// udp tracker protocol consts
+// see: http://bittorrent.org/beps/bep_0015.html
+const (
+	ProtocolId = uint64(0x41727101980)
+
+	ActionConnect  = uint32(0)
+	ActionAnnounce = uint32(1)
+	ActionScrape   = uint32(2)
+	ActionError    = uint32(3)
+
+	EventNone      = uint32(0)
+	EventCompleted = uint32(1)
+	EventStarted   = uint32(2)
+	EventStopped   = uint32(3)
+
+	// a connection id may be reused for one minute after it was received
+	ConnectionIdLifetime = 1 * time.Minute
+
+	// how long to wait on a tracker while sending the stopped event, so
+	// a slow tracker doesn't hold up shutting down
+	StoppedTimeout = 5 * time.Second
+)
+
+var ErrTimeout = errors.New("tracker request timed out")
+var ErrCancelled = errors.New("tracker request cancelled")
+
 type Tracker struct {
-	url           string
-	connection    *net.UDPConn
-	connected     bool
-	connection_id uint64
-	interval      uint32
-	seeders       uint32
-	leechers      uint32
-	peers         []*peer.Peer
-}
+	url                string
+	// the full announce url and its scheme (udp, http or https)
+	announce_url       *url.URL
+	scheme             string
+	// udp4 or udp6. when ipv6 is enabled every udp tracker gets a twin
+	// announcing over udp6 alongside it, since a tracker only returns peers
+	// of the address family the announce arrived on
+	network            string
+	ipv6               *Tracker
+	// sent back to http trackers that give us one
+	tracker_id         string
+	connection         net.Conn
+	connected          bool
+	connection_id      uint64
+	connection_id_time time.Time
+	interval           uint32
+	min_interval       uint32
+	seeders            uint32
+	leechers           uint32
+	// number of times the torrent has been downloaded, only known from scrapes
+	completed          uint32
+	scraped            bool
+	last_error         string
+	peers              []*peer.Peer
+	// the torrents byte counters, reported with every announce
+	stats              *stats.Stats
 
-func NewTracker(tracker_url string) *Tracker {
-	t := Tracker{}
-	t.connected = false
+	// when we last announced and whether it worked
+	last_announce      time.Time
+	announce_failed    bool
+	announced          bool
+
+	// closed to make requests give up, so closing doesn't wait on them
+	cancel             chan struct{}
+	// make a single short attempt at each request
+	quick              bool
+}
 
+// a tracker for an announce url. urls that aren't udp, http or https,
+// or have no host, are refused
+func NewTracker(tracker_url string) (*Tracker, error) {
 	u, err := url.Parse(tracker_url)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if u.Scheme != "udp" && u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported tracker url %q", tracker_url)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("tracker url %q has no host", tracker_url)
 	}
 
-	t.url = u.Host
-	if err != nil {
-		panic(err)
+	t := newTracker(u, "udp4")
+	// through a proxy both would announce from the proxies address
+	if config.EnableIPv6 && t.IsHttp() == false && proxy.Enabled() == false {
+		t.ipv6 = newTracker(u, "udp6")
 	}
 
+	return t, nil
+}
+
+func newTracker(u *url.URL, network string) *Tracker {
+	t := Tracker{}
+	t.network = network
+	t.connected = false
+	t.interval = uint32(config.TrackerDefaultInterval)
+	t.min_interval = uint32(config.TrackerMinInterval)
+	t.stats = stats.NewStats()
+	t.cancel = make(chan struct{})
+
+	t.url = u.Host
+	t.announce_url = u
+	t.scheme = u.Scheme
+
 	return &t
 }
 
+func (t *Tracker) SetStats(s *stats.Stats) {
+	t.stats = s
+	if t.ipv6 != nil {
+		t.ipv6.SetStats(s)
+	}
+}
+
+func (t *Tracker) IsHttp() bool {
+	return t.scheme == "http" || t.scheme == "https"
+}
+
+// is this a tracker on the i2p network, reached through the sam bridge
+func (t *Tracker) IsI2P() bool {
+	return strings.HasSuffix(t.announce_url.Hostname(), ".i2p")
+}
+
 func (t *Tracker) IsConnected() bool {
 	return t.connected
 }
 
-func (t *Tracker) Connect(done chan bool) {
-	sAddr, err := net.ResolveUDPAddr("udp", t.url)
-	if err != nil {
-		done <- false
-		return
+// the read timeout for the nth attempt at a request, 15 * 2 ^ n seconds
+func (t *Tracker) timeout(n int) time.Duration {
+	if t.quick {
+		return time.Duration(config.TrackerQuickTimeout) * time.Second
 	}
 
-	cAddr, err := net.ResolveUDPAddr("udp", ":0")
+	return time.Duration(15*(1<<uint(n))) * time.Second
+}
+
+// try requests once with a short timeout, or with the full schedule
+func (t *Tracker) setQuick(quick bool) {
+	t.quick = quick
+	if t.ipv6 != nil {
+		t.ipv6.setQuick(quick)
+	}
+}
+
+// send a request to the tracker and wait up to timeout for a response
+// carrying the same transaction id. responses to other transactions
+// are ignored. an error response (action 3) is returned as an error
+func (t *Tracker) request(req []byte, transaction_id uint32, action uint32, timeout time.Duration) ([]byte, error) {
+	n, err := t.connection.Write(req)
 	if err != nil {
-		done <- false
-		return
+		return nil, err
+	}
+	if n < len(req) {
+		return nil, errors.New("short write to tracker")
+	}
+
+	deadline := time.Now().Add(timeout)
+	t.connection.SetReadDeadline(deadline)
+
+	// cancelling wakes the read up by moving its deadline to now
+	conn := t.connection
+	cancel := t.cancel
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-cancel:
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	result := make([]byte, 65536)
+	for {
+		n, err := t.connection.Read(result)
+		if err != nil {
+			if t.cancelled() {
+				return nil, ErrCancelled
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return nil, ErrTimeout
+			}
+			return nil, err
+		}
+
+		// every response starts with action and transaction id
+		if n < 8 {
+			continue
+		}
+		if binary.BigEndian.Uint32(result[4:8]) != transaction_id {
+			continue
+		}
+
+		response := make([]byte, n)
+		copy(response, result[:n])
+
+		response_action := binary.BigEndian.Uint32(response[0:4])
+		if response_action == ActionError {
+			return nil, errors.New(string(response[8:]))
+		}
+		if response_action != action {
+			return nil, errors.New("unexpected tracker action")
+		}
+
+		return response, nil
+	}
+}
+
+// send a request, retransmitting it on timeout as described in BEP 15.
+// build is called before every attempt so requests can pick up a fresh
+// transaction id (and connection id, if the old one expired)
+func (t *Tracker) transact(action uint32, build func(transaction_id uint32) ([]byte, error)) ([]byte, error) {
+	retransmits := config.TrackerMaxRetransmits
+	if t.quick {
+		retransmits = 0
+	}
+
+	var err error
+	for n := 0; n <= retransmits; n++ {
+		if t.cancelled() {
+			return nil, ErrCancelled
+		}
+		transaction_id := rand.Uint32()
+
+		var req []byte
+		req, err = build(transaction_id)
+		if err != nil {
+			return nil, err
+		}
+
+		var response []byte
+		response, err = t.request(req, transaction_id, action, t.timeout(n))
+		if err == ErrTimeout {
+			continue
+		}
+		return response, err
 	}
 
-	t.connection, err = net.DialUDP("udp", cAddr, sAddr)
+	return nil, err
+}
+
+// open the udp socket to the tracker if it isn't open already
+func (t *Tracker) dial() error {
+	if t.connection != nil {
+		return nil
+	}
+
+	var err error
+	t.connection, err = proxy.DialUDP(t.network, t.url)
+	return err
+}
+
+// run the connect transaction, storing the connection id it returns
+func (t *Tracker) connect() error {
+	response, err := t.transact(ActionConnect, func(transaction_id uint32) ([]byte, error) {
+		return connectRequest(transaction_id), nil
+	})
 	if err != nil {
-		done <- false
-		return
+		return err
 	}
-	t.connection.SetReadDeadline(time.Now().Add(1 * time.Second))
 
+	return t.parseConnectResponse(response)
+}
+
+func connectRequest(transaction_id uint32) []byte {
 	var buf bytes.Buffer
-	binary.Write(&buf, binary.BigEndian, uint64(0x41727101980))
-	binary.Write(&buf, binary.BigEndian, uint32(0))
-	binary.Write(&buf, binary.BigEndian, uint32(123))
+	binary.Write(&buf, binary.BigEndian, ProtocolId)
+	binary.Write(&buf, binary.BigEndian, ActionConnect)
+	binary.Write(&buf, binary.BigEndian, transaction_id)
 
-	n, err := t.connection.Write(buf.Bytes())
-	if err != nil || n < len(buf.Bytes()) {
-		done <- false
-		return
+	return buf.Bytes()
+}
+
+func (t *Tracker) parseConnectResponse(response []byte) error {
+	if len(response) < 16 {
+		return errors.New("short connect response")
 	}
 
-	result := make([]byte, 16)
-	n, _, err = t.connection.ReadFromUDP(result)
-	if err != nil || n < len(result) {
-		done <- false
-		return
+	t.connection_id = binary.BigEndian.Uint64(response[8:16])
+	t.connection_id_time = time.Now()
+	t.connected = true
+
+	return nil
+}
+
+// get a connection id that is still valid, reconnecting if the
+// current one has expired
+func (t *Tracker) connectionId() (uint64, error) {
+	if time.Since(t.connection_id_time) >= ConnectionIdLifetime {
+		if err := t.connect(); err != nil {
+			return 0, err
+		}
 	}
 
-	action := binary.BigEndian.Uint32(result[0:4])
-	transaction_id := binary.BigEndian.Uint32(result[4:8])
-	t.connection_id = binary.BigEndian.Uint64(result[8:16])
+	return t.connection_id, nil
+}
+
+// announce to the tracker, returning whether it responded with a
+// usable peer list. with ipv6 enabled we announce over both address
+// families at once and succeed if either works
+func (t *Tracker) Announce(hash []byte, event uint32) bool {
+	if t.ipv6 == nil {
+		return t.announce(hash, event)
+	}
 
-	if action == 0 && transaction_id == 123 {
+	done := make(chan bool)
+	go func() {
+		done <- t.ipv6.announce(hash, event)
+	}()
+	ok := t.announce(hash, event)
+	ok6 := <-done
+
+	// an ipv6 only tracker drives the schedule and swarm stats
+	if ok == false && ok6 == true {
+		t.interval = t.ipv6.interval
+		t.min_interval = t.ipv6.min_interval
+		t.seeders = t.ipv6.seeders
+		t.leechers = t.ipv6.leechers
 		t.connected = true
+		t.announced = true
+		t.announce_failed = false
+		t.last_error = ""
+	}
+
+	return ok || ok6
+}
+
+// announce over a single address family. the socket is opened and a
+// connection id obtained first if needed
+func (t *Tracker) announce(hash []byte, event uint32) bool {
+	t.last_announce = time.Now()
+
+	if t.IsHttp() {
+		if err := t.announceHttp(hash, event); err != nil {
+			t.last_error = err.Error()
+			t.announce_failed = true
+			return false
+		}
+
+		t.connected = true
+		t.announce_failed = false
+		t.announced = true
+		return true
+	}
+
+	if err := t.dial(); err != nil {
+		t.last_error = err.Error()
+		t.announce_failed = true
+		return false
+	}
+
+	response, err := t.transact(ActionAnnounce, func(transaction_id uint32) ([]byte, error) {
+		connection_id, err := t.connectionId()
+		if err != nil {
+			return nil, err
+		}
+
+		return t.announceRequest(connection_id, transaction_id, hash, event), nil
+	})
+	if err != nil {
+		t.last_error = err.Error()
+		t.announce_failed = true
+		return false
+	}
+
+	if t.ParseAnnounceResponse(response) == false {
+		t.announce_failed = true
+		return false
 	}
 
-	done <- true
+	t.announce_failed = false
+	t.announced = true
+	return true
 }
 
-func (t *Tracker) Announce(hash []byte, done chan bool) {
+func (t *Tracker) announceRequest(connection_id uint64, transaction_id uint32, hash []byte, event uint32) []byte {
 	var buf bytes.Buffer
 	// connection id
-	binary.Write(&buf, binary.BigEndian, uint64(t.connection_id))
+	binary.Write(&buf, binary.BigEndian, connection_id)
 	// action
-	binary.Write(&buf, binary.BigEndian, uint32(1))
+	binary.Write(&buf, binary.BigEndian, ActionAnnounce)
 	// transaction id
-	binary.Write(&buf, binary.BigEndian, uint32(123))
+	binary.Write(&buf, binary.BigEndian, transaction_id)
 	// info hash
 	binary.Write(&buf, binary.LittleEndian, hash)
 	// peer id
 	binary.Write(&buf, binary.LittleEndian, []byte("UVG01234567891234567"))
 	// downloaded
-	binary.Write(&buf, binary.BigEndian, uint64(0))
+	binary.Write(&buf, binary.BigEndian, uint64(t.stats.GetDownloaded()))
 	// left
-	binary.Write(&buf, binary.BigEndian, uint64(0))
+	binary.Write(&buf, binary.BigEndian, uint64(t.stats.GetLeft()))
 	// uploaded
-	binary.Write(&buf, binary.BigEndian, uint64(0))
+	binary.Write(&buf, binary.BigEndian, uint64(t.stats.GetUploaded()))
 	// event
-	binary.Write(&buf, binary.BigEndian, uint32(2))
+	binary.Write(&buf, binary.BigEndian, event)
 	// ip
 	binary.Write(&buf, binary.BigEndian, uint32(0))
 	// key
@@ -117,77 +417,190 @@ func (t *Tracker) Announce(hash []byte, done chan bool) {
 	// num_want -1
 	binary.Write(&buf, binary.BigEndian, int32(-1))
 	// port
-	binary.Write(&buf, binary.BigEndian, uint16(0))
+	binary.Write(&buf, binary.BigEndian, uint16(config.ListenPort))
 	// extensions
 	binary.Write(&buf, binary.BigEndian, uint16(0))
 
-	n, err := t.connection.Write(buf.Bytes())
-	if err != nil || n < len(buf.Bytes()) {
-		done <- false
-		return
+	return buf.Bytes()
+}
+
+// parse an announce response whose transaction id has already been
+// matched against the request
+func (t *Tracker) ParseAnnounceResponse(announce_response []byte) bool {
+	if len(announce_response) < 20 {
+		return false
 	}
 
-	result := make([]byte, 2048)
-	t.connection.SetReadDeadline(time.Now().Add(1 * time.Second))
-	n, _, err = t.connection.ReadFromUDP(result)
-	if err != nil {
-		done <- false
-		return
+	action := binary.BigEndian.Uint32(announce_response[0:4])
+	if action != ActionAnnounce {
+		return false
 	}
 
-	t.connection.Close()
-	if t.ParseAnnounceResponse(result) == true {
-		done <- true
+	t.interval = binary.BigEndian.Uint32(announce_response[8:12])
+	if t.interval == 0 {
+		t.interval = uint32(config.TrackerDefaultInterval)
+	}
+	if t.min_interval > t.interval {
+		t.min_interval = t.interval
+	}
+	t.leechers = binary.BigEndian.Uint32(announce_response[12:16])
+	t.seeders = binary.BigEndian.Uint32(announce_response[16:20])
+
+	// peers come back in the address family of the socket we announced on
+	// see: http://bittorrent.org/beps/bep_0015.html#ipv6
+	if t.network == "udp6" {
+		t.peers = append(t.peers, parseCompactPeers(announce_response[20:], net.IPv6len)...)
 	} else {
-		done <- false
+		t.peers = append(t.peers, parseCompactPeers(announce_response[20:], net.IPv4len)...)
 	}
+
+	return true
 }
 
-func (t *Tracker) ParseAnnounceResponse(announce_response []byte) bool {
-	action := binary.BigEndian.Uint32(announce_response[0:4])
-	transaction_id := binary.BigEndian.Uint32(announce_response[4:8])
+// how long until the next regular announce. the tracker's interval is
+// used normally, min interval if we need peers or the last announce failed
+func (t *Tracker) NextAnnounce(peers_wanted bool) time.Duration {
+	interval := time.Duration(t.interval) * time.Second
+	if peers_wanted || t.announce_failed {
+		interval = time.Duration(t.min_interval) * time.Second
+	}
 
-	if action == 1 && transaction_id == 123 {
-		t.interval = binary.BigEndian.Uint32(announce_response[8:12])
-		t.leechers = binary.BigEndian.Uint32(announce_response[12:16])
-		t.seeders = binary.BigEndian.Uint32(announce_response[16:20])
+	wait := t.last_announce.Add(interval).Sub(time.Now())
+	if wait < 0 {
+		wait = 0
+	}
 
-		blank_ip := net.ParseIP("0.0.0.0")
+	return wait
+}
 
-		pos := 20
-		for pos < 2048 {
-			ip := make(net.IP, 4)
-			binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(announce_response[pos:pos+4]))
-			if ip.String() == blank_ip.String() {
-				break
-			}
-			port := binary.BigEndian.Uint16(announce_response[pos+4 : pos+6])
+// decode a list of compact peers, each an ip address of ip_len bytes
+// followed by a two byte port
+func parseCompactPeers(data []byte, ip_len int) []*peer.Peer {
+	peers := make([]*peer.Peer, 0)
+	for pos := 0; pos+ip_len+2 <= len(data); pos += ip_len + 2 {
+		ip := make(net.IP, ip_len)
+		copy(ip, data[pos:pos+ip_len])
+		if ip.IsUnspecified() || ipfilter.Default.IsBlocked(ip) {
+			continue
+		}
+		port := binary.BigEndian.Uint16(data[pos+ip_len : pos+ip_len+2])
 
-			t.peers = append(t.peers, peer.NewPeer(ip, port))
+		peers = append(peers, peer.NewPeer(ip, port))
+	}
 
-			pos += 6
-		}
+	return peers
+}
 
-		return true
-	} else {
-		return false
+// decode a compact i2p peer list, the 32 byte hashes of each peers
+// destination
+func parseI2PPeers(data []byte) []*peer.Peer {
+	peers := make([]*peer.Peer, 0)
+	for pos := 0; pos+32 <= len(data); pos += 32 {
+		peers = append(peers, peer.NewPeerAt(peer.Address{Destination: i2p.B32(data[pos : pos+32])}))
 	}
+
+	return peers
 }
 
-func (t *Tracker) Run(hash []byte, metadata chan []byte, request_chunk chan *peer.Peer) {
-	for _, p := range t.peers {
-		go p.Run(hash, metadata, request_chunk)
+// hand over the peers from the last announce
+func (t *Tracker) TakePeers() []*peer.Peer {
+	peers := t.peers
+	t.peers = nil
+
+	if t.ipv6 != nil {
+		peers = append(peers, t.ipv6.TakePeers()...)
 	}
+
+	return peers
 }
 
 func (t *Tracker) GetUrl() string {
 	return t.url
 }
 
-func (t *Tracker) Close() {
-	for _, p := range t.peers {
-		if p.IsConnected() {
-			p.Close()
+func (t *Tracker) GetSeeders() uint32 {
+	return t.seeders
+}
+
+func (t *Tracker) GetLeechers() uint32 {
+	return t.leechers
+}
+
+func (t *Tracker) GetCompleted() uint32 {
+	return t.completed
+}
+
+// have we got swarm stats from either a scrape or an announce
+func (t *Tracker) HasSwarmStats() bool {
+	return t.scraped || t.announced
+}
+
+// the last error reported by the tracker, or the reason the
+// last request to it failed
+func (t *Tracker) GetLastError() string {
+	return t.last_error
+}
+
+// make requests in progress give up, along with any made until Close
+func (t *Tracker) cancelRequests() {
+	select {
+	case <-t.cancel:
+	default:
+		close(t.cancel)
+	}
+
+	if t.ipv6 != nil {
+		t.ipv6.cancelRequests()
+	}
+}
+
+func (t *Tracker) cancelled() bool {
+	select {
+	case <-t.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// tell the tracker we're leaving. the stopped event is sent before this
+// returns, waiting no longer than StoppedTimeout on the tracker. nothing
+// else may be using the tracker by now
+func (t *Tracker) Close(hash []byte) {
+	// cancelled requests were from announcing, the stopped event goes out
+	// regardless
+	t.cancel = make(chan struct{})
+
+	if t.ipv6 != nil {
+		t.ipv6.Close(hash)
+	}
+
+	if t.IsHttp() {
+		if t.announced {
+			t.announceHttpWithin(hash, EventStopped, StoppedTimeout)
+		}
+		return
+	}
+
+	if t.connection != nil {
+		if t.announced {
+			t.sendStopped(hash)
 		}
+		t.connection.Close()
 	}
 }
+
+// send the stopped event to a udp tracker. our connection id has most
+// likely expired since the last announce, so we get a new one first,
+// trying only once. the tracker doesn't need to answer the event itself
+func (t *Tracker) sendStopped(hash []byte) {
+	if time.Since(t.connection_id_time) >= ConnectionIdLifetime {
+		transaction_id := rand.Uint32()
+		response, err := t.request(connectRequest(transaction_id), transaction_id, ActionConnect, StoppedTimeout)
+		if err != nil || t.parseConnectResponse(response) != nil {
+			return
+		}
+	}
+
+	t.connection.Write(t.announceRequest(t.connection_id, rand.Uint32(), hash, EventStopped))
+}
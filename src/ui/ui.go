@@ -1,33 +1,64 @@
 package ui
 
 import (
+    "fmt"
     "strings"
     "os/exec"
     "strconv"
     "runtime"
+    "unicode/utf8"
 
     "github.com/gizak/termui"
 
     "../tracker"
     "../file"
+    "../ipfilter"
+    "../ratelimit"
+    "../stats"
 )
 
+// keys for the bandwidth limits and blocklists, shown under the others
+const extra_keys = " \n  [d / D -> download limit down / up](fg-cyan) \n  [u / U -> upload limit down / up](fg-cyan) \n  [t / T -> torrent download limit down / up](fg-cyan) \n  [y / Y -> torrent upload limit down / up](fg-cyan) \n  [a     -> alternate limits on / off](fg-cyan) \n  [r     -> reload blocklists](fg-cyan) \n  [m     -> move download](fg-cyan)"
+
 type UI struct {
     current_page int
     tracker_text *termui.Par
     key *termui.Par
     files_list *termui.List
     gauge *termui.Gauge
+    stats_text *termui.Par
+    stats *stats.Stats
     trackers []*tracker.Tracker
     files []*file.File
-    file_chan chan int
+    file_chan chan []file.Priority
+
+    // the priority of each file, as the file list shows it
+    priorities []file.Priority
+    // changes a files priority once the download has started
+    prioritise func(*file.File, file.Priority)
 
     selecting_file bool
     file_selected bool
+    // the file the cursor is on, or len(files) for all of them
     selected_file int
+    // is there enough of the file to open it in vlc
+    can_view bool
 
     first_file int
     last_file int
+
+    // moves the torrent to a new save path
+    move func(string) error
+    // get and set the torrents own limits, on top of the global ones
+    get_limits func() (int, int)
+    set_limits func(int, int)
+    // the move prompt is open, with what's been typed so far
+    prompting bool
+    prompt string
+    // how the last move went
+    message string
+    // an error is showing in place of the progress
+    failed bool
 }
 
 func NewUI() *UI {
@@ -41,10 +72,17 @@ func NewUI() *UI {
 func (u *UI) update_trackers_text() {
     text := ""
     for _, t := range u.trackers {
-        if t.IsConnected() {
-            text = text + "  [Tracker :: " + t.GetUrl() + "](fg-cyan)\n"
+        swarm := ""
+        if t.HasSwarmStats() {
+            swarm = fmt.Sprintf(" :: %d seeders / %d leechers / %d completed", t.GetSeeders(), t.GetLeechers(), t.GetCompleted())
+        } else if t.GetLastError() != "" {
+            swarm = " :: " + t.GetLastError()
+        }
+
+        if t.IsConnected() || t.HasSwarmStats() {
+            text = text + "  [Tracker :: " + t.GetUrl() + swarm + "](fg-cyan)\n"
         } else {
-            text = text + "  [Tracker :: " + t.GetUrl() + "](fg-red)\n"
+            text = text + "  [Tracker :: " + t.GetUrl() + swarm + "](fg-red)\n"
         }
     }
 
@@ -108,8 +146,15 @@ func (u *UI) Init(name string, trackers []*tracker.Tracker) {
     u.gauge.Label = "Loading..."
     termui.Body.AddRows(termui.NewRow(termui.NewCol(2, 0, nil), termui.NewCol(8, 0, u.gauge)))
 
-    u.key = termui.NewPar("  [up    -> file list up](fg-red) \n  [down  -> file list down](fg-red) \n  [enter -> start download](fg-red) \n  [v     -> open video in vlc](fg-red) \n  [q     -> quit](fg-cyan)");
-    u.key.Height = len(u.trackers) + 2
+    u.stats_text = termui.NewPar("")
+    u.stats_text.Height = 5
+    u.stats_text.Width = 1
+    u.update_stats_text()
+    termui.Body.AddRows(termui.NewRow(termui.NewCol(2, 0, nil), termui.NewCol(8, 0, u.stats_text)))
+
+    u.key = termui.NewPar("")
+    u.update_key_text()
+    u.key.Height = strings.Count(u.key.Text, "\n") + 3
     u.key.Width = 1
     termui.Body.AddRows(termui.NewRow(termui.NewCol(2, 0, nil), termui.NewCol(8, 0, u.key)))
 
@@ -118,8 +163,8 @@ func (u *UI) Init(name string, trackers []*tracker.Tracker) {
 
     termui.Render(termui.Body)
 
-    termui.Handle("/sys/kbd/<up>", func(termui.Event) {
-        if u.selecting_file == true {
+    u.handle_key("/sys/kbd/<up>", func(termui.Event) {
+        if u.selecting_file == true || u.file_selected == true {
             if u.selected_file > 0 {
                 u.selected_file--
                 if u.selected_file < u.first_file {
@@ -133,8 +178,8 @@ func (u *UI) Init(name string, trackers []*tracker.Tracker) {
         }
     })
 
-    termui.Handle("/sys/kbd/<down>", func(termui.Event) {
-        if u.selecting_file == true {
+    u.handle_key("/sys/kbd/<down>", func(termui.Event) {
+        if u.selecting_file == true || u.file_selected == true {
             if u.selected_file < len(u.files) {
                 u.selected_file++
                 if u.selected_file > u.last_file {
@@ -148,21 +193,65 @@ func (u *UI) Init(name string, trackers []*tracker.Tracker) {
         }
     })
 
-    termui.Handle("/sys/kbd/<enter>", func(termui.Event) {
-        // up arrow
+    u.handle_key("/sys/kbd/<space>", func(termui.Event) {
+        if u.selecting_file == true || u.file_selected == true {
+            u.toggle_file()
+
+            u.update_files_text()
+            u.Refresh()
+        }
+    })
+
+    u.handle_key("/sys/kbd/+", func(termui.Event) {
+        if u.selecting_file == true || u.file_selected == true {
+            u.step_priority(1)
+
+            u.update_files_text()
+            u.Refresh()
+        }
+    })
+
+    u.handle_key("/sys/kbd/-", func(termui.Event) {
+        if u.selecting_file == true || u.file_selected == true {
+            u.step_priority(-1)
+
+            u.update_files_text()
+            u.Refresh()
+        }
+    })
+
+    u.handle_key("/sys/kbd/<enter>", func(termui.Event) {
         if u.selecting_file == true {
+            // with nothing ticked, enter downloads the file it's on
+            ticked := false
+            for _, priority := range u.priorities {
+                if priority != file.PrioritySkip {
+                    ticked = true
+                }
+            }
+            if ticked == false {
+                u.toggle_file()
+            }
+
             u.file_selected = true
             u.selecting_file = false
+            if u.selected_file == len(u.files) {
+                u.selected_file = 0
+            }
 
-            u.key.Text = "  [up    -> file list up](fg-red) \n  [down  -> file list down](fg-red) \n  [enter -> start download](fg-red) \n  [v     -> open video in vlc](fg-red) \n  [q     -> quit](fg-cyan)"
+            u.update_key_text()
+            u.update_files_text()
+            u.Refresh()
 
-            u.file_chan <- u.selected_file
+            priorities := make([]file.Priority, len(u.priorities))
+            copy(priorities, u.priorities)
+            u.file_chan <- priorities
         }
     })
 
-    termui.Handle("/sys/kbd/v", func(termui.Event) {
+    u.handle_key("/sys/kbd/v", func(termui.Event) {
         // launch vlc
-        if u.file_selected == true {
+        if u.file_selected == true && u.selected_file < len(u.files) {
             f := u.files[u.selected_file]
 
             if runtime.GOOS == "windows" && runtime.GOARCH == "amd64" {
@@ -177,11 +266,84 @@ func (u *UI) Init(name string, trackers []*tracker.Tracker) {
         }
     })
 
-    termui.Handle("/sys/kbd/q", func(termui.Event) {
+    u.handle_key("/sys/kbd/d", func(termui.Event) {
+        download, upload, _ := ratelimit.GetLimits()
+        ratelimit.SetLimits(step_limit(download, false), upload)
+        u.update_stats_text()
+        u.Refresh()
+    })
+
+    u.handle_key("/sys/kbd/D", func(termui.Event) {
+        download, upload, _ := ratelimit.GetLimits()
+        ratelimit.SetLimits(step_limit(download, true), upload)
+        u.update_stats_text()
+        u.Refresh()
+    })
+
+    u.handle_key("/sys/kbd/u", func(termui.Event) {
+        download, upload, _ := ratelimit.GetLimits()
+        ratelimit.SetLimits(download, step_limit(upload, false))
+        u.update_stats_text()
+        u.Refresh()
+    })
+
+    u.handle_key("/sys/kbd/U", func(termui.Event) {
+        download, upload, _ := ratelimit.GetLimits()
+        ratelimit.SetLimits(download, step_limit(upload, true))
+        u.update_stats_text()
+        u.Refresh()
+    })
+
+    u.handle_key("/sys/kbd/t", func(termui.Event) {
+        u.step_torrent_limits(true, false)
+    })
+
+    u.handle_key("/sys/kbd/T", func(termui.Event) {
+        u.step_torrent_limits(true, true)
+    })
+
+    u.handle_key("/sys/kbd/y", func(termui.Event) {
+        u.step_torrent_limits(false, false)
+    })
+
+    u.handle_key("/sys/kbd/Y", func(termui.Event) {
+        u.step_torrent_limits(false, true)
+    })
+
+    u.handle_key("/sys/kbd/a", func(termui.Event) {
+        ratelimit.ToggleAlt()
+        u.update_stats_text()
+        u.Refresh()
+    })
+
+    u.handle_key("/sys/kbd/r", func(termui.Event) {
+        ipfilter.Default.Reload()
+        u.update_stats_text()
+        u.Refresh()
+    })
+
+    u.handle_key("/sys/kbd/q", func(termui.Event) {
         // enter
         termui.StopLoop()
     })
 
+    u.handle_key("/sys/kbd/m", func(termui.Event) {
+        // not while choosing files, the torrent is waiting on us then
+        if u.move != nil && u.selecting_file == false {
+            u.prompting = true
+            u.prompt = ""
+            u.update_stats_text()
+            u.Refresh()
+        }
+    })
+
+    // keys without a handler of their own only matter to the prompt
+    termui.Handle("/sys/kbd", func(e termui.Event) {
+        if u.prompting {
+            u.prompt_key(e)
+        }
+    })
+
     termui.Handle("/sys/wnd/resize", func(e termui.Event) {
         termui.Body.Width = termui.TermWidth()
         u.Refresh()
@@ -189,46 +351,337 @@ func (u *UI) Init(name string, trackers []*tracker.Tracker) {
 
     termui.Handle("/timer/1s", func(e termui.Event) {
         u.update_trackers_text()
+        u.update_stats_text()
         u.Refresh()
     })
 
     termui.Loop()
 }
 
+func (u *UI) update_stats_text() {
+    if u.stats == nil {
+        return
+    }
+
+    u.stats_text.Text = "  [down :: " + format_bytes(u.stats.GetDownloaded()) + "](fg-cyan)" +
+        "  [up :: " + format_bytes(u.stats.GetUploaded()) + "](fg-cyan)" +
+        "  [left :: " + format_bytes(u.stats.GetLeft()) + "](fg-cyan)" +
+        "  [corrupt :: " + format_bytes(u.stats.GetCorrupt()) + "](fg-red)"
+
+    download, upload, alt := ratelimit.GetLimits()
+    limits := "  [limits :: " + format_limit(download) + " down / " + format_limit(upload) + " up"
+    if alt {
+        limits += " (alternate)"
+    }
+    u.stats_text.Text += "\n" + limits + "](fg-cyan)"
+    if u.get_limits != nil {
+        download, upload := u.get_limits()
+        u.stats_text.Text += "  [torrent :: " + format_limit(download) + " down / " + format_limit(upload) + " up](fg-cyan)"
+    }
+    u.stats_text.Text += "  [blocked :: " + strconv.FormatInt(ipfilter.Default.GetBlocked(), 10) + "](fg-red)"
+
+    if u.prompting {
+        u.stats_text.Text += "\n  [move to :: " + u.prompt + "_](fg-cyan)"
+    } else if u.message != "" {
+        u.stats_text.Text += "\n  [" + u.message + "](fg-cyan)"
+    }
+}
+
+// halve or double the torrents download or upload limit
+func (u *UI) step_torrent_limits(download bool, up bool) {
+    if u.get_limits == nil {
+        return
+    }
+
+    down_limit, up_limit := u.get_limits()
+    if download {
+        down_limit = step_limit(down_limit, up)
+    } else {
+        up_limit = step_limit(up_limit, up)
+    }
+    u.set_limits(down_limit, up_limit)
+
+    u.update_stats_text()
+    u.Refresh()
+}
+
+// handle a key, unless the move prompt is open, in which case the key is
+// typed into the prompt
+func (u *UI) handle_key(path string, handler func(termui.Event)) {
+    termui.Handle(path, func(e termui.Event) {
+        if u.prompting {
+            u.prompt_key(e)
+            return
+        }
+        handler(e)
+    })
+}
+
+// edit the move prompt. enter moves the torrent, in the background as
+// moving between disks can take a while, and escape closes the prompt
+func (u *UI) prompt_key(e termui.Event) {
+    key := ""
+    if kbd, ok := e.Data.(termui.EvtKbd); ok {
+        key = kbd.KeyStr
+    }
+
+    switch key {
+    case "<enter>":
+        u.prompting = false
+        if path := strings.TrimSpace(u.prompt); path != "" {
+            u.message = "moving to " + path + "..."
+            go func() {
+                if err := u.move(path); err != nil {
+                    u.message = "couldn't move to " + path + ": " + err.Error()
+                } else {
+                    u.message = "moved to " + path
+                }
+            }()
+        }
+    case "<escape>":
+        u.prompting = false
+    case "C-8", "<backspace>":
+        if u.prompt != "" {
+            _, size := utf8.DecodeLastRuneInString(u.prompt)
+            u.prompt = u.prompt[:len(u.prompt)-size]
+        }
+    case "<space>":
+        u.prompt += " "
+    default:
+        if utf8.RuneCountInString(key) == 1 {
+            u.prompt += key
+        }
+    }
+
+    u.update_stats_text()
+    u.Refresh()
+}
+
+// tick or untick the file the cursor is on. on all, every file is ticked
+// unless they already all are
+func (u *UI) toggle_file() {
+    if u.selected_file == len(u.files) {
+        priority := file.PrioritySkip
+        for _, p := range u.priorities {
+            if p == file.PrioritySkip {
+                priority = file.PriorityNormal
+            }
+        }
+        for i := range u.files {
+            u.set_priority(i, priority)
+        }
+        return
+    }
+
+    if u.priorities[u.selected_file] == file.PrioritySkip {
+        u.set_priority(u.selected_file, file.PriorityNormal)
+    } else {
+        u.set_priority(u.selected_file, file.PrioritySkip)
+    }
+}
+
+// raise or lower the priority of the file the cursor is on, or of every
+// file on all. lowering below low skips the file
+func (u *UI) step_priority(step int) {
+    for i := range u.files {
+        if i == u.selected_file || u.selected_file == len(u.files) {
+            priority := u.priorities[i] + file.Priority(step)
+            if priority >= file.PrioritySkip && priority <= file.PriorityHigh {
+                u.set_priority(i, priority)
+            }
+        }
+    }
+}
+
+// once the download has started the torrent is told straight away,
+// before that it's told when enter is pressed
+func (u *UI) set_priority(i int, priority file.Priority) {
+    u.priorities[i] = priority
+    if u.file_selected && u.prioritise != nil {
+        u.prioritise(u.files[i], priority)
+    }
+}
+
+// what the keys do, in cyan if they do anything right now
+func (u *UI) update_key_text() {
+    browsing := u.selecting_file || u.file_selected
+
+    u.key.Text = key_line("up    -> file list up", browsing) + " \n" +
+        key_line("down  -> file list down", browsing) + " \n" +
+        key_line("space -> download file on / off", browsing) + " \n" +
+        key_line("+ / - -> file priority up / down", browsing) + " \n" +
+        key_line("enter -> start download", u.selecting_file) + " \n" +
+        key_line("v     -> open video in vlc", u.file_selected && u.can_view) + " \n" +
+        key_line("q     -> quit", true) + extra_keys
+}
+
+func key_line(text string, active bool) string {
+    if active {
+        return "  [" + text + "](fg-cyan)"
+    }
+
+    return "  [" + text + "](fg-red)"
+}
+
+// the box in front of a file in the list
+func priority_box(priority file.Priority) string {
+    switch priority {
+    case file.PriorityLow:
+        return "[lo]"
+    case file.PriorityNormal:
+        return "[::]"
+    case file.PriorityHigh:
+        return "[hi]"
+    }
+
+    return "[  ]"
+}
+
+func format_limit(limit int) string {
+    if limit == 0 {
+        return "unlimited"
+    }
+
+    return format_bytes(ratelimit.KiB(limit)) + "/s"
+}
+
+// halve or double a limit in KiB/s. lowering from unlimited starts at
+// 1 MiB/s and raising past 64 MiB/s goes back to unlimited
+func step_limit(limit int, up bool) int {
+    if up {
+        if limit == 0 || limit * 2 > 64 * 1024 {
+            return 0
+        }
+        return limit * 2
+    }
+
+    if limit == 0 {
+        return 1024
+    }
+    if limit / 2 < 16 {
+        return 16
+    }
+
+    return limit / 2
+}
+
+func format_bytes(n int64) string {
+    units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+    value := float64(n)
+    unit := 0
+    for value >= 1024 && unit < len(units) - 1 {
+        value /= 1024
+        unit++
+    }
+
+    return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+func (u *UI) SetStats(s *stats.Stats) {
+    u.stats = s
+}
+
 func (u *UI) update_files_text() {
     strs := []string{}
     
+    all := file.PriorityNormal
     for i, f := range u.files {
+        if u.priorities[i] == file.PrioritySkip {
+            all = file.PrioritySkip
+        }
         if i >= u.first_file && i <= u.last_file {
             path := strings.Join(f.GetDisplayPath(), "/")
-            if i == u.selected_file {
-                strs = append(strs, "[[::] " + path + "](fg-cyan)")
-            } else {
-                strs = append(strs, "[[  ] " + path + "](fg-red)")
-            }
+            strs = append(strs, file_line(priority_box(u.priorities[i]) + " " + path, i == u.selected_file, u.priorities[i]))
         }
     }
     if u.selected_file > len(u.files) - 6 {
-        if u.selected_file == len(u.files) {
-            strs = append(strs, "[[::] all](fg-cyan)")
-        } else {
-            strs = append(strs, "[[  ] all](fg-red)")
-        }
+        strs = append(strs, file_line(priority_box(all) + " all", u.selected_file == len(u.files), all))
     }
 
     u.files_list.Items = strs
 }
 
-func (u *UI) SelectFile(files []*file.File, file_chan chan int) {
-    u.gauge.Label = "Selecting file to view..."
-    u.key.Text = "  [up    -> file list up](fg-cyan) \n  [down  -> file list down](fg-cyan) \n  [enter -> start download](fg-cyan) \n  [v     -> open video in vlc](fg-red) \n  [q     -> quit](fg-cyan)"
+// the cursor is in black on cyan, files being downloaded in cyan and
+// skipped ones in red
+func file_line(text string, cursor bool, priority file.Priority) string {
+    if cursor {
+        return "[" + text + "](fg-black,bg-cyan)"
+    }
+    if priority == file.PrioritySkip {
+        return "[" + text + "](fg-red)"
+    }
+
+    return "[" + text + "](fg-cyan)"
+}
+
+// let the user tick the files to download. their priorities are sent on
+// file_chan once they're done
+func (u *UI) SelectFile(files []*file.File, file_chan chan []file.Priority) {
+    u.gauge.Label = "Selecting files to download..."
 
     u.file_chan = file_chan
     u.files = files
+    u.priorities = make([]file.Priority, len(files))
+    u.selecting_file = true
+    u.update_key_text()
     u.update_files_text()
 
-    u.selecting_file = true
+    u.Refresh()
+}
+
+// show files that were picked without asking, such as by the magnet link.
+// selected is the one v opens
+func (u *UI) ShowSelectedFiles(files []*file.File, selected int) {
+    u.files = files
+    u.priorities = make([]file.Priority, len(files))
+    for i, f := range files {
+        u.priorities[i] = f.GetPriority()
+    }
+    u.selected_file = selected
+    u.file_selected = true
+    u.can_view = true
+    u.update_key_text()
+    u.update_files_text()
+
+    u.Refresh()
+}
+
+// show why the torrent can't be downloaded in place of its progress
+func (u *UI) SetError(message string) {
+    u.failed = true
+    u.gauge.Label = message
+    u.gauge.Percent = 0
+    u.gauge.BarColor = termui.ColorRed
+    u.Refresh()
+}
+
+// show a message under the stats, such as something that went wrong
+// with a file
+func (u *UI) SetMessage(message string) {
+    u.message = message
+    u.update_stats_text()
+    u.Refresh()
+}
+
+// what to call to change a files priority once the download has started
+func (u *UI) SetPrioritise(prioritise func(*file.File, file.Priority)) {
+    u.prioritise = prioritise
+}
+
+// what to call to move the torrent when asked to
+func (u *UI) SetMove(move func(string) error) {
+    u.move = move
+}
 
+// what to call to get and change the torrents own limits
+func (u *UI) SetLimiter(get_limits func() (int, int), set_limits func(int, int)) {
+    u.get_limits = get_limits
+    u.set_limits = set_limits
+}
+
+// replace the name shown in the title, once we know the torrents real name
+func (u *UI) SetName(name string) {
+    u.tracker_text.BorderLabel = "Torrent :: " + name
     u.Refresh()
 }
 
@@ -240,10 +693,16 @@ func (u *UI) Refresh() {
 }
 
 func (u *UI) SetPercent(completed int, total int) {
+    // an error stays until it's been seen
+    if u.failed {
+        return
+    }
+
     var f float64 = float64(completed) / float64(total) * 100
     u.gauge.Percent = int(f)
-    u.gauge.Label = "{{percent}}% (" + strconv.FormatInt(int64(completed), 10) + " / " + strconv.FormatInt(int64(total), 10) + " chunks completed)"
-    if u.gauge.Percent >= 10 {
-        u.key.Text = "  [up    -> file list up](fg-red) \n  [down  -> file list down](fg-red) \n  [enter -> start download](fg-red) \n  [v     -> open video in vlc](fg-cyan) \n  [q     -> quit](fg-cyan)"
+    u.gauge.Label = "{{percent}}% (" + format_bytes(int64(completed)) + " / " + format_bytes(int64(total)) + " completed)"
+    if u.gauge.Percent >= 10 && u.can_view == false {
+        u.can_view = true
+        u.update_key_text()
     }
 }
\ No newline at end of file
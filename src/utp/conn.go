@@ -0,0 +1,593 @@
+package utp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// largest payload we put in a packet, small enough to avoid
+	// fragmentation on most links
+	MaxPayload = 1400 - HeaderLength - 6
+
+	// LEDBAT aims to add no more than this much queuing delay
+	TargetDelay = 100000
+	// the most the window grows per round trip, in packets
+	MaxCwndIncrease = 3000
+
+	// the most unread data we buffer, advertised to the peer as our window
+	ReceiveBuffer = 1024 * 1024
+
+	// a connection is given up on after this many retransmissions
+	MaxRetransmissions = 8
+	MinTimeout         = 500 * time.Millisecond
+	SynTimeout         = 3 * time.Second
+)
+
+const (
+	stateSynSent = iota
+	stateConnected
+	stateFinSent
+	stateClosed
+)
+
+var (
+	ErrReset   = errors.New("utp: connection reset by peer")
+	ErrTimeout = errors.New("utp: connection timed out")
+)
+
+// returned when a deadline passes, so callers can tell it from a
+// broken connection
+type timeoutError struct{}
+
+func (e timeoutError) Error() string   { return "utp: i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+// a packet we've sent and are waiting on an ack for
+type outgoing struct {
+	p             *packet
+	sent          time.Time
+	transmissions int
+	length        int
+}
+
+// a utp connection, usable anywhere a net.Conn is
+type Conn struct {
+	socket  *Socket
+	addr    *net.UDPAddr
+	recv_id uint16
+	send_id uint16
+	state   int
+	err     error
+
+	// next sequence number to send and last in order one received
+	seq_nr uint16
+	ack_nr uint16
+
+	// unacked packets in sequence order
+	out      []*outgoing
+	cwnd     float64
+	peer_wnd uint32
+	rtt      time.Duration
+	rtt_var  time.Duration
+	timeout  time.Duration
+	dup_acks int
+	last_ack uint16
+	// the delay we measured on the peers last packet, echoed back to it
+	reply_micro uint32
+	// the lowest delays seen this minute and last, the base LEDBAT
+	// measures queuing delay against
+	base_delays [2]uint32
+	base_minute time.Time
+
+	// data and fins received out of order, keyed on sequence number
+	inbound      map[uint16]*packet
+	read_buf     bytes.Buffer
+	fin_received bool
+	eof_seq      uint16
+	eof          bool
+
+	read_deadline  time.Time
+	write_deadline time.Time
+
+	lock sync.Mutex
+	cond *sync.Cond
+	done chan bool
+}
+
+func newConn(s *Socket, addr *net.UDPAddr, recv_id uint16, send_id uint16) *Conn {
+	c := Conn{}
+	c.socket = s
+	c.addr = addr
+	c.recv_id = recv_id
+	c.send_id = send_id
+	c.cwnd = MaxPayload * 2
+	c.peer_wnd = MaxPayload * 2
+	c.timeout = time.Second
+	c.inbound = make(map[uint16]*packet)
+	c.base_minute = time.Now()
+	c.cond = sync.NewCond(&c.lock)
+	c.done = make(chan bool)
+
+	go c.tick()
+
+	return &c
+}
+
+// send a syn and wait for the peer to answer it
+func (c *Conn) connect(timeout time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.state = stateSynSent
+	c.seq_nr = 1
+	c.sendPacket(StSyn, nil, c.recv_id)
+
+	deadline := time.Now().Add(timeout)
+	for c.state == stateSynSent && c.err == nil {
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+		c.cond.Wait()
+	}
+
+	return c.err
+}
+
+// answer a syn from the peer
+func (c *Conn) accept(syn *packet) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.state = stateConnected
+	c.seq_nr = uint16(rand.Uint32())
+	c.ack_nr = syn.seq_nr
+	c.peer_wnd = syn.wnd_size
+	c.reply_micro = now() - syn.timestamp
+	c.sendState()
+}
+
+// acknowledge a retransmitted syn
+func (c *Conn) ackSyn() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state != stateClosed {
+		c.sendState()
+	}
+}
+
+// queue a packet for sending, sequence numbered unless it's an ack.
+// must be called with the lock held
+func (c *Conn) sendPacket(kind uint8, payload []byte, connection_id uint16) {
+	p := &packet{kind: kind, connection_id: connection_id, seq_nr: c.seq_nr, ack_nr: c.ack_nr, payload: payload}
+	c.seq_nr++
+
+	o := &outgoing{p: p, length: len(payload)}
+	c.out = append(c.out, o)
+	c.transmit(o)
+}
+
+func (c *Conn) transmit(o *outgoing) {
+	o.p.ack_nr = c.ack_nr
+	o.p.timestamp = now()
+	o.p.timestamp_diff = c.reply_micro
+	o.p.wnd_size = c.receiveWindow()
+	o.sent = time.Now()
+	o.transmissions++
+
+	c.socket.write(o.p.encode(), c.addr)
+}
+
+// send an ack, with a selective ack of anything received out of order
+func (c *Conn) sendState() {
+	p := &packet{kind: StState, connection_id: c.send_id, seq_nr: c.seq_nr, ack_nr: c.ack_nr}
+	p.timestamp = now()
+	p.timestamp_diff = c.reply_micro
+	p.wnd_size = c.receiveWindow()
+
+	if len(c.inbound) > 0 {
+		mask := make([]byte, 4)
+		for seq := range c.inbound {
+			bit := int(seq - c.ack_nr - 2)
+			if bit < 0 || bit >= 32 {
+				continue
+			}
+			mask[bit/8] |= 1 << uint(bit%8)
+		}
+		p.selective_ack = mask
+	}
+
+	c.socket.write(p.encode(), c.addr)
+}
+
+func (c *Conn) receiveWindow() uint32 {
+	free := ReceiveBuffer - c.read_buf.Len()
+	if free < 0 {
+		free = 0
+	}
+
+	return uint32(free)
+}
+
+func (c *Conn) bytesInFlight() int {
+	n := 0
+	for _, o := range c.out {
+		n += o.length
+	}
+
+	return n
+}
+
+func (c *Conn) handlePacket(p *packet) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	defer c.cond.Broadcast()
+
+	if c.state == stateClosed {
+		return
+	}
+
+	c.reply_micro = now() - p.timestamp
+	c.peer_wnd = p.wnd_size
+
+	if p.kind == StReset {
+		c.err = ErrReset
+		c.close()
+		return
+	}
+
+	if c.state == stateSynSent {
+		if p.kind != StState {
+			return
+		}
+		c.state = stateConnected
+		c.ack_nr = p.seq_nr - 1
+	}
+
+	c.handleAck(p)
+
+	if p.kind == StData || p.kind == StFin {
+		c.handleData(p)
+	}
+}
+
+// drop acked packets from the out queue, adjusting the round trip time
+// and congestion window
+func (c *Conn) handleAck(p *packet) {
+	acked_bytes := 0
+	remaining := make([]*outgoing, 0, len(c.out))
+	for i, o := range c.out {
+		acked := seqLess(p.ack_nr, o.p.seq_nr) == false
+		if acked == false && p.selective_ack != nil {
+			bit := int(o.p.seq_nr - p.ack_nr - 2)
+			if bit >= 0 && bit/8 < len(p.selective_ack) {
+				acked = p.selective_ack[bit/8]&(1<<uint(bit%8)) != 0
+			}
+		}
+
+		if acked == false {
+			remaining = append(remaining, c.out[i])
+			continue
+		}
+
+		acked_bytes += o.length
+		if o.transmissions == 1 {
+			c.updateRtt(time.Since(o.sent))
+		}
+	}
+	c.out = remaining
+
+	if acked_bytes > 0 {
+		c.updateCwnd(acked_bytes, p.timestamp_diff)
+		c.dup_acks = 0
+	} else if p.kind == StState && p.ack_nr == c.last_ack && len(c.out) > 0 {
+		c.dup_acks++
+	}
+	c.last_ack = p.ack_nr
+
+	// three duplicate acks, or three packets selectively acked past the
+	// first one we're missing, means it was lost
+	lost := c.dup_acks >= 3
+	if p.selective_ack != nil && len(c.out) > 0 {
+		count := 0
+		for _, b := range p.selective_ack {
+			for ; b != 0; b &= b - 1 {
+				count++
+			}
+		}
+		if count >= 3 {
+			lost = true
+		}
+	}
+	if lost && len(c.out) > 0 && c.out[0].transmissions == 1 {
+		c.cwnd /= 2
+		if c.cwnd < MaxPayload {
+			c.cwnd = MaxPayload
+		}
+		c.transmit(c.out[0])
+		c.dup_acks = 0
+	}
+}
+
+func (c *Conn) updateRtt(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rtt_var = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rtt_var += (delta - c.rtt_var) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+
+	c.timeout = c.rtt + c.rtt_var*4
+	if c.timeout < MinTimeout {
+		c.timeout = MinTimeout
+	}
+}
+
+// LEDBAT, grow the window while the queuing delay the peer measures is
+// under target and shrink it when it's over
+// see: http://bittorrent.org/beps/bep_0029.html#congestion-control
+func (c *Conn) updateCwnd(acked_bytes int, delay uint32) {
+	if delay == 0 {
+		return
+	}
+
+	if time.Since(c.base_minute) > time.Minute {
+		c.base_delays[1] = c.base_delays[0]
+		c.base_delays[0] = 0
+		c.base_minute = time.Now()
+	}
+	if c.base_delays[0] == 0 || delay < c.base_delays[0] {
+		c.base_delays[0] = delay
+	}
+
+	base_delay := c.base_delays[0]
+	if c.base_delays[1] != 0 && c.base_delays[1] < base_delay {
+		base_delay = c.base_delays[1]
+	}
+
+	queuing_delay := float64(delay - base_delay)
+	off_target := (TargetDelay - queuing_delay) / TargetDelay
+	window_factor := float64(acked_bytes) / c.cwnd
+	c.cwnd += MaxCwndIncrease * off_target * window_factor
+
+	if c.cwnd < MaxPayload {
+		c.cwnd = MaxPayload
+	}
+}
+
+// deliver data in order, holding anything that arrives early
+func (c *Conn) handleData(p *packet) {
+	if seqLess(c.ack_nr, p.seq_nr) {
+		if p.seq_nr-c.ack_nr < 0x4000 {
+			c.inbound[p.seq_nr] = p
+		}
+
+		for {
+			next, ok := c.inbound[c.ack_nr+1]
+			if ok == false {
+				break
+			}
+			delete(c.inbound, c.ack_nr+1)
+			c.ack_nr++
+
+			if next.kind == StFin {
+				c.fin_received = true
+				c.eof_seq = next.seq_nr
+				continue
+			}
+			c.read_buf.Write(next.payload)
+		}
+	}
+
+	if c.fin_received && c.ack_nr == c.eof_seq {
+		c.eof = true
+	}
+
+	c.sendState()
+}
+
+// handles retransmission timeouts and wakes anyone waiting on a deadline
+func (c *Conn) tick() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		c.lock.Lock()
+		if len(c.out) > 0 {
+			o := c.out[0]
+			timeout := c.timeout
+			if o.p.kind == StSyn {
+				timeout = SynTimeout
+			}
+
+			if time.Since(o.sent) > timeout {
+				if o.transmissions > MaxRetransmissions || (o.p.kind == StSyn && o.transmissions >= 3) {
+					c.err = ErrTimeout
+					c.close()
+				} else {
+					// a timeout means loss, start again from one packet
+					c.cwnd = MaxPayload
+					c.timeout *= 2
+					c.transmit(o)
+				}
+			}
+		}
+		c.cond.Broadcast()
+		c.lock.Unlock()
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for c.read_buf.Len() == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.read_deadline.IsZero() == false && time.Now().After(c.read_deadline) {
+			return 0, timeoutError{}
+		}
+		c.cond.Wait()
+	}
+
+	window_was_closed := c.receiveWindow() < MaxPayload
+	n, _ := c.read_buf.Read(b)
+	// let the peer know it can send again
+	if window_was_closed && c.receiveWindow() >= MaxPayload {
+		c.sendState()
+	}
+
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	written := 0
+	for written < len(b) {
+		if c.err != nil {
+			return written, c.err
+		}
+		if c.state != stateConnected {
+			return written, ErrClosed
+		}
+		if c.write_deadline.IsZero() == false && time.Now().After(c.write_deadline) {
+			return written, timeoutError{}
+		}
+
+		size := len(b) - written
+		if size > MaxPayload {
+			size = MaxPayload
+		}
+
+		window := int(c.cwnd)
+		if int(c.peer_wnd) < window {
+			window = int(c.peer_wnd)
+		}
+		// always allow one packet in flight so a zero window can't stall us
+		if c.bytesInFlight() > 0 && c.bytesInFlight()+size > window {
+			c.cond.Wait()
+			continue
+		}
+
+		payload := make([]byte, size)
+		copy(payload, b[written:written+size])
+		c.sendPacket(StData, payload, c.send_id)
+		written += size
+	}
+
+	return written, nil
+}
+
+// send a fin, then tear the connection down once it's been acked or
+// we give up waiting
+func (c *Conn) Close() error {
+	c.lock.Lock()
+	if c.state == stateConnected {
+		c.sendPacket(StFin, nil, c.send_id)
+		c.state = stateFinSent
+	}
+	c.lock.Unlock()
+
+	go func() {
+		deadline := time.Now().Add(10 * time.Second)
+
+		c.lock.Lock()
+		for len(c.out) > 0 && c.err == nil && time.Now().Before(deadline) {
+			c.cond.Wait()
+		}
+		c.close()
+		c.lock.Unlock()
+	}()
+
+	return nil
+}
+
+// tell the peer to drop the connection
+func (c *Conn) reset() {
+	c.socket.sendReset(c.addr, c.send_id, c.ack_nr)
+	c.destroy()
+}
+
+// close without waiting for the peer
+func (c *Conn) destroy() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.err == nil {
+		c.err = ErrClosed
+	}
+	c.close()
+}
+
+// must be called with the lock held
+func (c *Conn) close() {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	if c.err == nil {
+		c.err = ErrClosed
+	}
+	close(c.done)
+	c.socket.remove(c)
+	c.cond.Broadcast()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
+
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.read_deadline = t
+	c.cond.Broadcast()
+
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.write_deadline = t
+	c.cond.Broadcast()
+
+	return nil
+}
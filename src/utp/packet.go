@@ -0,0 +1,120 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// packet types
+const (
+	StData  = uint8(0)
+	StFin   = uint8(1)
+	StState = uint8(2)
+	StReset = uint8(3)
+	StSyn   = uint8(4)
+
+	Version = uint8(1)
+
+	HeaderLength = 20
+
+	ExtensionNone         = uint8(0)
+	ExtensionSelectiveAck = uint8(1)
+)
+
+var ErrNotUtp = errors.New("utp: not a utp packet")
+
+type packet struct {
+	kind           uint8
+	connection_id  uint16
+	timestamp      uint32
+	timestamp_diff uint32
+	wnd_size       uint32
+	seq_nr         uint16
+	ack_nr         uint16
+	// bit i set means packet ack_nr + 2 + i has been received
+	selective_ack []byte
+	payload       []byte
+}
+
+// microseconds, truncated to 32 bits as the header requires
+func now() uint32 {
+	return uint32(time.Now().UnixNano() / 1000)
+}
+
+func parsePacket(data []byte) (*packet, error) {
+	if len(data) < HeaderLength {
+		return nil, ErrNotUtp
+	}
+
+	p := packet{}
+	p.kind = data[0] >> 4
+	if data[0]&0x0f != Version || p.kind > StSyn {
+		return nil, ErrNotUtp
+	}
+
+	extension := data[1]
+	p.connection_id = binary.BigEndian.Uint16(data[2:4])
+	p.timestamp = binary.BigEndian.Uint32(data[4:8])
+	p.timestamp_diff = binary.BigEndian.Uint32(data[8:12])
+	p.wnd_size = binary.BigEndian.Uint32(data[12:16])
+	p.seq_nr = binary.BigEndian.Uint16(data[16:18])
+	p.ack_nr = binary.BigEndian.Uint16(data[18:20])
+
+	pos := HeaderLength
+	for extension != ExtensionNone {
+		if pos+2 > len(data) {
+			return nil, ErrNotUtp
+		}
+		next := data[pos]
+		length := int(data[pos+1])
+		pos += 2
+		if pos+length > len(data) {
+			return nil, ErrNotUtp
+		}
+		if extension == ExtensionSelectiveAck {
+			p.selective_ack = data[pos : pos+length]
+		}
+		pos += length
+		extension = next
+	}
+
+	p.payload = data[pos:]
+
+	return &p, nil
+}
+
+func (p *packet) encode() []byte {
+	length := HeaderLength + len(p.payload)
+	if p.selective_ack != nil {
+		length += 2 + len(p.selective_ack)
+	}
+
+	data := make([]byte, length)
+	data[0] = p.kind<<4 | Version
+	if p.selective_ack != nil {
+		data[1] = ExtensionSelectiveAck
+	}
+	binary.BigEndian.PutUint16(data[2:4], p.connection_id)
+	binary.BigEndian.PutUint32(data[4:8], p.timestamp)
+	binary.BigEndian.PutUint32(data[8:12], p.timestamp_diff)
+	binary.BigEndian.PutUint32(data[12:16], p.wnd_size)
+	binary.BigEndian.PutUint16(data[16:18], p.seq_nr)
+	binary.BigEndian.PutUint16(data[18:20], p.ack_nr)
+
+	pos := HeaderLength
+	if p.selective_ack != nil {
+		data[pos] = ExtensionNone
+		data[pos+1] = uint8(len(p.selective_ack))
+		copy(data[pos+2:], p.selective_ack)
+		pos += 2 + len(p.selective_ack)
+	}
+	copy(data[pos:], p.payload)
+
+	return data
+}
+
+// is sequence number a before b, allowing for wraparound
+func seqLess(a uint16, b uint16) bool {
+	return int16(a-b) < 0
+}
@@ -0,0 +1,80 @@
+package utp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	packets := []*packet{
+		{kind: StSyn, connection_id: 1234, timestamp: 1, seq_nr: 1},
+		{kind: StData, connection_id: 65535, timestamp: 4000000000, timestamp_diff: 12, wnd_size: ReceiveBuffer, seq_nr: 65535, ack_nr: 7, payload: []byte("data")},
+		{kind: StState, connection_id: 2, seq_nr: 3, ack_nr: 4, selective_ack: []byte{0x05, 0, 0, 0x80}},
+		{kind: StFin, connection_id: 3, seq_nr: 9, ack_nr: 8, selective_ack: []byte{1, 2, 3, 4}, payload: []byte("after the extension")},
+	}
+
+	for _, want := range packets {
+		got, err := parsePacket(want.encode())
+		if err != nil {
+			t.Fatalf("parse of %+v: %v", want, err)
+		}
+
+		if got.kind != want.kind || got.connection_id != want.connection_id ||
+			got.timestamp != want.timestamp || got.timestamp_diff != want.timestamp_diff ||
+			got.wnd_size != want.wnd_size || got.seq_nr != want.seq_nr || got.ack_nr != want.ack_nr {
+			t.Errorf("header = %+v, want %+v", got, want)
+		}
+		if bytes.Equal(got.selective_ack, want.selective_ack) == false {
+			t.Errorf("selective ack = %x, want %x", got.selective_ack, want.selective_ack)
+		}
+		if bytes.Equal(got.payload, want.payload) == false {
+			t.Errorf("payload = %q, want %q", got.payload, want.payload)
+		}
+	}
+}
+
+func TestParseNotUtp(t *testing.T) {
+	valid := (&packet{kind: StState, selective_ack: []byte{0, 0, 0, 0}}).encode()
+
+	wrong_version := append([]byte{}, valid...)
+	wrong_version[0] = StState<<4 | 2
+	wrong_kind := append([]byte{}, valid...)
+	wrong_kind[0] = 5<<4 | Version
+
+	tests := [][]byte{
+		// a dht message sharing the socket
+		[]byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"),
+		valid[:HeaderLength-1],
+		wrong_version,
+		wrong_kind,
+		// the extension runs past the end of the packet
+		valid[:HeaderLength+3],
+	}
+
+	for _, data := range tests {
+		if _, err := parsePacket(data); err != ErrNotUtp {
+			t.Errorf("parse of %x = %v, want %v", data, err, ErrNotUtp)
+		}
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	tests := []struct {
+		a, b uint16
+		want bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{5, 5, false},
+		// across the wraparound
+		{65535, 0, true},
+		{0, 65535, false},
+		{65000, 100, true},
+	}
+
+	for _, test := range tests {
+		if got := seqLess(test.a, test.b); got != test.want {
+			t.Errorf("seqLess(%d, %d) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
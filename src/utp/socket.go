@@ -0,0 +1,258 @@
+package utp
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// a udp socket carrying any number of utp connections. packets that
+// aren't utp (such as dht messages, which are bencoded dictionaries)
+// are passed to the fallback handler so the socket can be shared
+// see: http://bittorrent.org/beps/bep_0029.html
+type Socket struct {
+	connection *net.UDPConn
+	// connections keyed on remote address and the connection id they
+	// send to us with
+	conns    map[string]*Conn
+	accepted chan *Conn
+	fallback func([]byte, *net.UDPAddr)
+	closed   chan bool
+	lock     sync.Mutex
+}
+
+var ErrClosed = errors.New("utp: socket closed")
+
+// the socket Dial uses, opened by the first call to Listen
+var default_socket *Socket
+var default_lock sync.Mutex
+
+// listen for utp connections on the given udp port. the first socket
+// opened becomes the one outgoing connections are dialled from
+func Listen(network string, port int) (*Socket, error) {
+	connection, err := net.ListenUDP(network, &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+
+	s := NewSocket(connection)
+
+	default_lock.Lock()
+	if default_socket == nil {
+		default_socket = s
+	}
+	default_lock.Unlock()
+
+	return s, nil
+}
+
+func NewSocket(connection *net.UDPConn) *Socket {
+	s := Socket{}
+	s.connection = connection
+	s.conns = make(map[string]*Conn)
+	s.accepted = make(chan *Conn, 32)
+	s.closed = make(chan bool)
+
+	go s.read()
+
+	return &s
+}
+
+// dial a utp connection from the default socket, opening an ephemeral
+// one if nothing is listening yet
+func Dial(address string, timeout time.Duration) (net.Conn, error) {
+	default_lock.Lock()
+	s := default_socket
+	if s == nil {
+		connection, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			default_lock.Unlock()
+			return nil, err
+		}
+		s = NewSocket(connection)
+		default_socket = s
+	}
+	default_lock.Unlock()
+
+	return s.Dial(address, timeout)
+}
+
+// hand packets that aren't utp to f
+func (s *Socket) SetFallback(f func([]byte, *net.UDPAddr)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.fallback = f
+}
+
+// send a packet that isn't utp, such as a dht message, from this socket
+func (s *Socket) WriteTo(b []byte, addr *net.UDPAddr) (int, error) {
+	return s.connection.WriteToUDP(b, addr)
+}
+
+func (s *Socket) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	var c *Conn
+	for {
+		recv_id := uint16(rand.Uint32())
+		if _, ok := s.conns[connKey(addr, recv_id)]; ok == false {
+			c = newConn(s, addr, recv_id, recv_id+1)
+			s.conns[connKey(addr, recv_id)] = c
+			break
+		}
+	}
+	s.lock.Unlock()
+
+	if err := c.connect(timeout); err != nil {
+		c.destroy()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// wait for the next incoming connection, making the socket a net.Listener
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accepted:
+		return c, nil
+	case <-s.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.connection.LocalAddr()
+}
+
+func (s *Socket) Close() error {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+		close(s.closed)
+	}
+
+	s.lock.Lock()
+	conns := make([]*Conn, 0)
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.lock.Unlock()
+
+	for _, c := range conns {
+		c.destroy()
+	}
+
+	default_lock.Lock()
+	if default_socket == s {
+		default_socket = nil
+	}
+	default_lock.Unlock()
+
+	return s.connection.Close()
+}
+
+func connKey(addr *net.UDPAddr, id uint16) string {
+	return addr.String() + "/" + strconv.Itoa(int(id))
+}
+
+func (s *Socket) read() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.connection.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			return
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		p, err := parsePacket(data)
+		if err != nil {
+			s.lock.Lock()
+			fallback := s.fallback
+			s.lock.Unlock()
+			if fallback != nil {
+				fallback(data, addr)
+			}
+			continue
+		}
+
+		s.handlePacket(p, addr)
+	}
+}
+
+func (s *Socket) handlePacket(p *packet, addr *net.UDPAddr) {
+	s.lock.Lock()
+	c, ok := s.conns[connKey(addr, p.connection_id)]
+
+	if ok == false && p.kind == StSyn {
+		// the initiator receives on the id in the syn and sends on id + 1,
+		// so we do the opposite
+		if existing, exists := s.conns[connKey(addr, p.connection_id+1)]; exists {
+			s.lock.Unlock()
+			// our answer to the syn was lost, send it again
+			existing.ackSyn()
+			return
+		}
+		c = newConn(s, addr, p.connection_id+1, p.connection_id)
+		s.conns[connKey(addr, c.recv_id)] = c
+		s.lock.Unlock()
+
+		c.accept(p)
+
+		select {
+		case s.accepted <- c:
+		default:
+			// nobody is accepting, refuse the connection
+			c.reset()
+		}
+		return
+	}
+	s.lock.Unlock()
+
+	if ok == false {
+		if p.kind != StReset {
+			s.sendReset(addr, p.connection_id, p.seq_nr)
+		}
+		return
+	}
+
+	c.handlePacket(p)
+}
+
+func (s *Socket) sendReset(addr *net.UDPAddr, connection_id uint16, ack_nr uint16) {
+	p := packet{kind: StReset, connection_id: connection_id, ack_nr: ack_nr, timestamp: now()}
+	s.connection.WriteToUDP(p.encode(), addr)
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conns[connKey(c.addr, c.recv_id)] == c {
+		delete(s.conns, connKey(c.addr, c.recv_id))
+	}
+}
+
+func (s *Socket) write(b []byte, addr *net.UDPAddr) error {
+	_, err := s.connection.WriteToUDP(b, addr)
+	return err
+}
@@ -0,0 +1,169 @@
+package utp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestSocket(t *testing.T) *Socket {
+	connection, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewSocket(connection)
+}
+
+// dial from one socket to another over loopback
+func connectPair(t *testing.T, dialer *Socket, listener *Socket) (net.Conn, net.Conn) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	dialled, err := dialer.Dial(listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case conn := <-accepted:
+		return dialled, conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't accepted")
+	}
+
+	return nil, nil
+}
+
+func TestTransfer(t *testing.T) {
+	a := newTestSocket(t)
+	defer a.Close()
+	b := newTestSocket(t)
+	defer b.Close()
+
+	dialled, accepted := connectPair(t, a, b)
+	defer accepted.Close()
+
+	// more than the receive buffer, so the window has to open again
+	data := make([]byte, ReceiveBuffer+MaxPayload*10+123)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	go func() {
+		dialled.Write(data)
+		dialled.Close()
+	}()
+
+	accepted.SetReadDeadline(time.Now().Add(20 * time.Second))
+	received, err := ioutil.ReadAll(accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(received, data) == false {
+		t.Errorf("received %d bytes that don't match the %d sent", len(received), len(data))
+	}
+}
+
+func TestBothWays(t *testing.T) {
+	a := newTestSocket(t)
+	defer a.Close()
+	b := newTestSocket(t)
+	defer b.Close()
+
+	dialled, accepted := connectPair(t, a, b)
+	defer dialled.Close()
+	defer accepted.Close()
+
+	if _, err := dialled.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(accepted, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := accepted.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	dialled.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(dialled, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "pong" {
+		t.Errorf("reply = %q, want %q", reply, "pong")
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	a := newTestSocket(t)
+	defer a.Close()
+
+	// a udp port nobody answers on
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	start := time.Now()
+	if _, err := a.Dial(silent.LocalAddr().String(), 500*time.Millisecond); err != ErrTimeout {
+		t.Errorf("dial error = %v, want %v", err, ErrTimeout)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("dial took %v, longer than its timeout", time.Since(start))
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	a := newTestSocket(t)
+	defer a.Close()
+	b := newTestSocket(t)
+	defer b.Close()
+
+	dialled, accepted := connectPair(t, a, b)
+	defer dialled.Close()
+	defer accepted.Close()
+
+	accepted.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := accepted.Read(make([]byte, 1))
+	if nerr, ok := err.(net.Error); ok == false || nerr.Timeout() == false {
+		t.Errorf("read error = %v, want a timeout", err)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	a := newTestSocket(t)
+	defer a.Close()
+
+	received := make(chan []byte, 1)
+	a.SetFallback(func(data []byte, addr *net.UDPAddr) {
+		received <- data
+	})
+
+	sender, err := net.DialUDP("udp4", nil, a.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	message := []byte("d1:q4:pinge")
+	sender.Write(message)
+
+	select {
+	case data := <-received:
+		if bytes.Equal(data, message) == false {
+			t.Errorf("fallback got %q, want %q", data, message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message wasn't passed to the fallback")
+	}
+}
@@ -1,7 +1,16 @@
 package main
 
 import (
+	"./src/config"
+	"./src/i2p"
+	"./src/ipfilter"
+	"./src/listener"
+	"./src/lsd"
+	"./src/proxy"
+	"./src/ratelimit"
 	"./src/torrent"
+	"./src/tracker"
+	"./src/utp"
     "./src/ui"
 	"fmt"
 	"os"
@@ -10,37 +19,173 @@ import (
 )
 
 func main() {
-	t := torrent.NewTorrent(os.Args[1])
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	if os.Args[1] == "scrape" {
+		scrape(os.Args[2:])
+		return
+	}
+
+	if err := ipfilter.Default.Reload(); err != nil {
+		fmt.Println("could not load blocklist:", err)
+	}
+
+	t, err := torrent.NewTorrent(os.Args[1])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(os.Args) > 2 {
+		t.SetSavePath(os.Args[2])
+	}
+
+	ratelimit.Start()
+
+	// in proxy only mode nothing is listened on, since incoming connections,
+	// utp and local service discovery would all reveal our address
+	l := listener.NewListener()
+	for _, hash := range t.SwarmHashes() {
+		l.Register(hash, t.IncomingPeers())
+	}
+	if proxy.Only() == false {
+		if err := l.Listen(); err != nil {
+			fmt.Println("not accepting incoming connections:", err)
+		}
+	}
+
+	// utp shares the tcp port number. outgoing utp connections are dialled
+	// from the same socket so peers can connect back to it
+	if config.TransportPreference != "tcp" && proxy.Only() == false {
+		network := "udp4"
+		if config.EnableIPv6 {
+			network = "udp"
+		}
+		s, err := utp.Listen(network, config.ListenPort)
+		if err != nil {
+			fmt.Println("not accepting incoming utp connections:", err)
+		} else {
+			l.Serve(s)
+		}
+	}
+
+	d := lsd.NewLSD()
+	if config.EnableLSD && proxy.Only() == false {
+		for _, hash := range t.SwarmHashes() {
+			d.Register(hash, t.FoundPeers())
+		}
+		if err := d.Listen(); err != nil {
+			fmt.Println("local service discovery disabled:", err)
+		}
+	}
+
+	// i2p peers are dialled and accepted through a session on the router's
+	// sam bridge
+	var session *i2p.Session
+	if config.EnableI2P {
+		var err error
+		session, err = i2p.NewSession(config.SAMAddress, config.I2PSessionName)
+		if err != nil {
+			fmt.Println("i2p disabled:", err)
+		} else {
+			l.Serve(session)
+		}
+	}
+
+	// reload the blocklists on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			ipfilter.Default.Reload()
+		}
+	}()
 
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
+		ratelimit.Stop()
+		d.Close()
+		l.Close()
 		cleanup(t)
+		if session != nil {
+			session.Close()
+		}
 		os.Exit(0)
 	}()
 
-    go run(t)
+    go t.Run()
 	
     ui := ui.NewUI()
     t.SetUI(ui)
     ui.Init(t.Name, t.Trackers)
 
+    ratelimit.Stop()
+    d.Close()
+    l.Close()
     t.Close()
+    if session != nil {
+        session.Close()
+    }
 }
 
-func run(t *torrent.Torrent) {
-    t.ConnectTrackers()
-    t.AnnounceTrackers()
-    t.Run()
+func usage() {
+	fmt.Println("usage: uvgTorrent \"magnet:magneturigoeshere\" [save path]")
+	fmt.Println("       uvgTorrent scrape <magnet uri | info hash> [tracker url ...]")
+	os.Exit(1)
+}
+
+// print seeders, leechers and completed downloads for a torrent
+// from each of its trackers, plus any trackers given on the command line
+func scrape(args []string) {
+	if len(args) < 1 {
+		usage()
+	}
+
+	hash, tracker_urls, err := torrent.ParseScrapeTarget(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	tracker_urls = append(tracker_urls, args[1:]...)
+
+	if len(tracker_urls) == 0 {
+		fmt.Println("no trackers to scrape")
+		os.Exit(1)
+	}
+
+	trackers := make([]*tracker.Tracker, 0)
+	urls := make([]string, 0)
+	for _, u := range tracker_urls {
+		track, err := tracker.NewTracker(u)
+		if err != nil {
+			fmt.Printf("%s\n    error: %s\n", u, err)
+			continue
+		}
+		trackers = append(trackers, track)
+		urls = append(urls, u)
+	}
+
+	tracker.ScrapeAll(trackers, hash)
+
+	for i, track := range trackers {
+		if track.HasSwarmStats() {
+			fmt.Printf("%s\n    seeders: %d leechers: %d completed: %d\n", urls[i], track.GetSeeders(), track.GetLeechers(), track.GetCompleted())
+		} else {
+			fmt.Printf("%s\n    error: %s\n", urls[i], track.GetLastError())
+		}
+		track.Close(hash)
+	}
 }
 
 func cleanup(t *torrent.Torrent) {
 	fmt.Println()
 	fmt.Println("cleaning up")
 
-	// torrent close will tell the trackers to close all of the peers connections
-	// causing the peers to gracefully exit
+	// torrent close will send the trackers a stopped event and close all of
+	// the peers connections, causing the peers to gracefully exit
 	// it will also close any open file handles
 	t.Close()
 }